@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type accessConfig struct {
+	Allow        []string `json:"allow"`
+	Deny         []string `json:"deny"`
+	AllowFiles   []string `json:"allow_files"`
+	DenyFiles    []string `json:"deny_files"`
+	DefaultDeny  bool     `json:"default_deny"`
+	DenyTemplate string   `json:"deny_template"`
+}
+
+// accessList holds the allow and deny CIDR lists of a route or of the whole
+// proxy. The lists loaded from files are re-read on SIGHUP.
+type accessList struct {
+	cfg   *accessConfig
+	rules atomic.Pointer[accessRules]
+}
+
+type accessRules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	page  *template.Template
+}
+
+func newAccessList(cfg *accessConfig) (*accessList, error) {
+	a := &accessList{cfg: cfg}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *accessList) load() error {
+	rules := &accessRules{}
+	var err error
+	if rules.allow, err = loadPrefixes(a.cfg.Allow, a.cfg.AllowFiles); err != nil {
+		return err
+	}
+	if rules.deny, err = loadPrefixes(a.cfg.Deny, a.cfg.DenyFiles); err != nil {
+		return err
+	}
+	if a.cfg.DenyTemplate != "" {
+		if rules.page, err = template.ParseFiles(a.cfg.DenyTemplate); err != nil {
+			return err
+		}
+	}
+	a.rules.Store(rules)
+	return nil
+}
+
+// allowed checks the deny list first, then the allow list, and falls back
+// to the default policy when the address matches neither.
+func (a *accessList) allowed(ip netip.Addr) bool {
+	rules := a.rules.Load()
+	if containsAddr(rules.deny, ip) {
+		return false
+	}
+	if containsAddr(rules.allow, ip) {
+		return true
+	}
+	return !a.cfg.DefaultDeny
+}
+
+func (a *accessList) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if a.allowed(ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		page := a.rules.Load().page
+		if page == nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		page.Execute(w, struct {
+			ClientIP  string
+			Path      string
+			RequestID string
+		}{ip.String(), r.URL.Path, requestID(r)})
+	})
+}
+
+func loadPrefixes(inline []string, files []string) ([]netip.Prefix, error) {
+	prefixes, err := parsePrefixes(inline)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range files {
+		list, err := readList(name)
+		if err != nil {
+			return nil, err
+		}
+		p, err := parsePrefixes(list)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		prefixes = append(prefixes, p...)
+	}
+	return prefixes, nil
+}
+
+// readList reads a file with one entry per line, skipping blank lines and
+// "#" comments.
+func readList(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			list = append(list, line)
+		}
+	}
+	return list, scanner.Err()
+}
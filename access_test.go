@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAccessListAllowed(t *testing.T) {
+	dir := t.TempDir()
+	denyFile := filepath.Join(dir, "deny.txt")
+	if err := os.WriteFile(denyFile, []byte("# blocked\n198.51.100.7 # scanner\n\n2001:db8:bad::/48\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		cfg  accessConfig
+		ip   string
+		want bool
+	}{
+		{"no lists", accessConfig{}, "203.0.113.1", true},
+		{"default deny", accessConfig{DefaultDeny: true}, "203.0.113.1", false},
+		{"allowed", accessConfig{Allow: []string{"10.0.0.0/8"}, DefaultDeny: true}, "10.1.2.3", true},
+		{"not allowed", accessConfig{Allow: []string{"10.0.0.0/8"}, DefaultDeny: true}, "11.1.2.3", false},
+		{"denied", accessConfig{Deny: []string{"10.0.0.0/8"}}, "10.1.2.3", false},
+		{"not denied", accessConfig{Deny: []string{"10.0.0.0/8"}}, "11.1.2.3", true},
+		{"deny wins over allow", accessConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.5"}}, "10.0.0.5", false},
+		{"deny wins over narrower allow", accessConfig{Allow: []string{"10.0.0.5"}, Deny: []string{"10.0.0.0/8"}}, "10.0.0.5", false},
+		{"allow rest of the range", accessConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.5"}, DefaultDeny: true}, "10.0.0.6", true},
+		{"deny file", accessConfig{Allow: []string{"198.51.100.0/24"}, DenyFiles: []string{denyFile}}, "198.51.100.7", false},
+		{"deny file IPv6", accessConfig{DenyFiles: []string{denyFile}}, "2001:db8:bad::1", false},
+		{"IPv6 allow", accessConfig{Allow: []string{"2001:db8::/32"}, DefaultDeny: true}, "2001:db8::1", true},
+		{"mapped address", accessConfig{Deny: []string{"::ffff:10.0.0.0/104"}}, "10.1.2.3", false},
+	} {
+		a, err := newAccessList(&tt.cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := a.allowed(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("%s: allowed(%s) = %v, want %v", tt.name, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAccessListWrap(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "denied.html")
+	if err := os.WriteFile(page, []byte("<p>{{.ClientIP}} may not see {{.Path}}</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	trusted, _ := parsePrefixes([]string{"10.0.0.1"})
+	for _, tt := range []struct {
+		name   string
+		cfg    accessConfig
+		xff    string
+		status int
+		body   string
+	}{
+		{"allowed client", accessConfig{Deny: []string{"198.51.100.0/24"}}, "203.0.113.1", http.StatusOK, "ok"},
+		{"denied client", accessConfig{Deny: []string{"198.51.100.0/24"}}, "198.51.100.7", http.StatusForbidden, "Forbidden\n"},
+		{"denied through the proxy address", accessConfig{Deny: []string{"10.0.0.1"}}, "203.0.113.1", http.StatusOK, "ok"},
+		{"deny page", accessConfig{Deny: []string{"198.51.100.0/24"}, DenyTemplate: page}, "198.51.100.7", http.StatusForbidden, "<p>198.51.100.7 may not see /app</p>"},
+	} {
+		a, err := newAccessList(&tt.cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		h := withClientIP(trusted, a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})))
+		r := httptest.NewRequest("GET", "/app", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", tt.xff)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status || w.Body.String() != tt.body {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, w.Code, w.Body, tt.status, tt.body)
+		}
+	}
+	if _, err := newAccessList(&accessConfig{Deny: []string{"10.0.0.0/33"}}); err == nil || !strings.Contains(err.Error(), "10.0.0.0/33") {
+		t.Errorf("invalid prefix: %v", err)
+	}
+}
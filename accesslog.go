@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type accessLogConfig struct {
+	Format        string       `json:"format"`
+	Template      string       `json:"template"`
+	Output        string       `json:"output"`
+	MaxSize       int64        `json:"max_size"`
+	MaxBackups    int          `json:"max_backups"`
+	Sample        []sampleRule `json:"sample"`
+	ExcludePaths  []string     `json:"exclude_paths"`
+	Headers       []string     `json:"headers"`
+	RedactHeaders []string     `json:"redact_headers"`
+	RedactCookies []string     `json:"redact_cookies"`
+	KeepCookies   []string     `json:"keep_cookies"`
+	RedactQuery   []string     `json:"redact_query"`
+}
+
+type accessLogEntry struct {
+	Time              time.Time         `json:"time"`
+	ClientIP          string            `json:"client_ip"`
+	Method            string            `json:"method"`
+	URI               string            `json:"uri"`
+	Proto             string            `json:"proto"`
+	Host              string            `json:"host"`
+	Status            int               `json:"status"`
+	Bytes             int64             `json:"bytes"`
+	DurationMS        float64           `json:"duration_ms"`
+	Route             string            `json:"route"`
+	Upstream          string            `json:"upstream,omitempty"`
+	UpstreamLatencyMS float64           `json:"upstream_latency_ms,omitempty"`
+	RequestID         string            `json:"request_id,omitempty"`
+	Referer           string            `json:"referer,omitempty"`
+	UserAgent         string            `json:"user_agent,omitempty"`
+	Headers           map[string]string `json:"headers,omitempty"`
+}
+
+const (
+	commonLogFormat   = `{{.ClientIP}} - - [{{.Time.Format "02/Jan/2006:15:04:05 -0700"}}] "{{.Method}} {{.URI}} {{.Proto}}" {{.Status}} {{if .Bytes}}{{.Bytes}}{{else}}-{{end}}`
+	combinedLogFormat = commonLogFormat + ` "{{or .Referer "-"}}" "{{or .UserAgent "-"}}"`
+)
+
+// accessLog writes one line per request in the Common or Combined Log
+// Format, as JSON, or with a user defined text/template over
+// accessLogEntry.
+type accessLog struct {
+	template *template.Template
+	json     bool
+	headers  []string
+	filter   *logFilter
+	out      io.Writer
+	mu       sync.Mutex
+}
+
+func newAccessLog(cfg accessLogConfig) (*accessLog, error) {
+	filter, err := newLogFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	l := &accessLog{filter: filter, headers: cfg.Headers}
+	text := ""
+	switch cfg.Format {
+	case "", "combined":
+		text = combinedLogFormat
+	case "common":
+		text = commonLogFormat
+	case "json":
+		l.json = true
+	case "template":
+		if cfg.Template == "" {
+			return nil, fmt.Errorf("template format without a template")
+		}
+		text = cfg.Template
+	default:
+		return nil, fmt.Errorf("unknown format %q", cfg.Format)
+	}
+	if text != "" {
+		t, err := template.New("access").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		l.template = t
+	}
+
+	switch cfg.Output {
+	case "", "stdout":
+		l.out = os.Stdout
+	case "stderr":
+		l.out = os.Stderr
+	default:
+		f, err := openRotatingFile(cfg.Output, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		onReload(f.reopen)
+		l.out = f
+	}
+	return l, nil
+}
+
+func (l *accessLog) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.filter.excluded(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info := infoOf(r)
+		sw := &statusWriter{ResponseWriter: w}
+		uri := r.URL.RequestURI()
+		headers := l.filter.headers(r.Header, l.headers)
+		next.ServeHTTP(sw, r)
+
+		if !l.filter.sampled(info.route, sw.status()) {
+			return
+		}
+		l.write(&accessLogEntry{
+			Time:              info.start,
+			ClientIP:          clientIP(r).String(),
+			Method:            r.Method,
+			URI:               l.filter.uri(uri),
+			Proto:             r.Proto,
+			Host:              r.Host,
+			Status:            sw.status(),
+			Bytes:             sw.bytes,
+			DurationMS:        milliseconds(time.Since(info.start)),
+			Route:             info.route,
+			Upstream:          info.upstream,
+			UpstreamLatencyMS: milliseconds(info.upstreamLatency),
+			RequestID:         requestID(r),
+			Referer:           l.filter.uri(r.Referer()),
+			UserAgent:         r.UserAgent(),
+			Headers:           headers,
+		})
+	})
+}
+
+func (l *accessLog) write(e *accessLogEntry) {
+	var buf bytes.Buffer
+	if l.json {
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(e)
+	} else {
+		if err := l.template.Execute(&buf, e); err != nil {
+			fmt.Fprintf(&buf, "access log template error: %v", err)
+		}
+		buf.WriteByte('\n')
+	}
+	l.mu.Lock()
+	l.out.Write(buf.Bytes())
+	l.mu.Unlock()
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// rotatingFile is a log file which is renamed with a timestamp suffix when
+// it grows over maxSize bytes, keeping at most maxBackups old files. It is
+// reopened on SIGHUP, so external rotation works too.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) reopen() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f != nil {
+		f.f.Close()
+	}
+	f.f, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize && f.size > 0 {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	backup := f.path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	f.f.Close()
+	f.f, f.size = file, 0
+
+	if f.maxBackups > 0 {
+		backups, _ := filepath.Glob(f.path + ".*")
+		sort.Strings(backups)
+		for len(backups) > f.maxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type adminConfig struct {
+	Listen  string `json:"listen"`
+	Persist bool   `json:"persist"`
+	Token   string `json:"token,omitempty"`
+}
+
+// serveAdmin runs the admin listener, which is kept apart from the proxied
+// traffic and bound to localhost unless configured otherwise.
+func serveAdmin(cfg adminConfig, rt *router, configPath string) {
+	if cfg.Listen == "" {
+		cfg.Listen = "127.0.0.1:9901"
+	}
+	api := newRoutesAPI(rt)
+	if cfg.Persist {
+		if configPath == "" {
+			log.Fatal("admin persist needs a config file")
+		}
+		api.configPath = configPath
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.Handle("/api/routes", api)
+	mux.Handle("/api/routes/", api)
+	mux.Handle("/api/inspect", requestInspector)
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, proxyStatus.snapshot(rt.table.Load()))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardPage.Execute(w, proxyStatus.snapshot(rt.table.Load())); err != nil {
+			log.Printf("error rendering dashboard: %v", err)
+		}
+	})
+
+	server := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           adminGuard(cfg, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("admin listening on %s", cfg.Listen)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// adminGuard keeps web pages from using the admin listener through the
+// browser of someone running the proxy: requests with an Origin header are
+// rejected, and so are Host names other than IP addresses, localhost and
+// the listen host, which defeats DNS rebinding. With a token, the API also
+// needs it as a bearer token.
+func adminGuard(cfg adminConfig, next http.Handler) http.Handler {
+	listenHost, _, _ := net.SplitHostPort(cfg.Listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			writeError(w, http.StatusForbidden, fmt.Errorf("cross-origin requests are not allowed"))
+			return
+		}
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		host = strings.Trim(host, "[]")
+		if net.ParseIP(host) == nil && !strings.EqualFold(host, "localhost") && (listenHost == "" || !strings.EqualFold(host, listenHost)) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("host %q is not allowed", r.Host))
+			return
+		}
+		if cfg.Token != "" && strings.HasPrefix(r.URL.Path, "/api/") {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid or missing bearer token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+var dashboardPage = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"ago": func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return time.Since(*t).Round(time.Second).String() + " ago"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>go-reverse-proxy</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.3em 1em; border-bottom: 1px solid #ddd; }
+.up { color: #080; } .down { color: #c00; }
+</style>
+</head>
+<body>
+<h1>go-reverse-proxy</h1>
+<p>{{.ClientConnections}} client connections, {{.UpstreamConnections}} upstream connections. JSON at <a href="/api/status">/api/status</a>, metrics at <a href="/metrics">/metrics</a>.</p>
+
+<h2>Routes</h2>
+<table>
+<tr><th>Name</th><th>Prefix</th><th>Upstream</th><th>Requests/s (1m)</th><th>In flight</th></tr>
+{{range .Routes}}<tr><td>{{.Name}}{{if .Maintenance}} (maintenance){{end}}</td><td>{{.Prefix}}</td><td>{{if .Stub}}stub{{end}}{{range .Targets}}{{.URL}} (weight {{.Weight}}{{if .Drain}}, draining{{end}}, {{.InFlight}} in flight)<br>{{end}}</td><td>{{printf "%.2f" .Rate}}</td><td>{{.InFlight}}</td></tr>
+{{end}}</table>
+<p>Routing table version {{.Version}}.</p>
+
+<h2>Upstreams</h2>
+<table>
+<tr><th>Upstream</th><th>State</th><th>Requests</th><th>Errors</th><th>Last success</th><th>Last error</th></tr>
+{{range .Upstreams}}<tr><td>{{.Upstream}}</td>{{if .Up}}<td class="up">up</td>{{else}}<td class="down">down</td>{{end}}<td>{{.Requests}}</td><td>{{.Errors}}</td><td>{{ago .LastSuccess}}</td><td>{{if .LastError}}{{ago .LastErrorAt}}: {{.LastError}}{{else}}-{{end}}</td></tr>
+{{else}}<tr><td colspan="6">No upstream requests yet.</td></tr>
+{{end}}</table>
+
+<h2>Recent errors</h2>
+<table>
+<tr><th>Time</th><th>Route</th><th>Request ID</th><th>Request</th><th>Status</th><th>Error</th></tr>
+{{range .RecentErrors}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Route}}</td><td>{{.RequestID}}</td><td>{{.Method}} {{.Path}}</td><td>{{.Status}}</td><td>{{.Error}}</td></tr>
+{{else}}<tr><td colspan="6">No errors.</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
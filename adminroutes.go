@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	errRouteNotFound  = errors.New("route not found")
+	errRouteExists    = errors.New("route already exists")
+	errTargetNotFound = errors.New("target not found")
+	errPathNotAllowed = errors.New("file path is not in the config file")
+)
+
+// routesAPI manages the routing table at runtime:
+//
+//	GET    /api/routes                               list the routes
+//	POST   /api/routes?index=N                       add a route
+//	GET    /api/routes/{name}                        get a route
+//	PUT    /api/routes/{name}                        replace a route
+//	DELETE /api/routes/{name}                        remove a route
+//	GET    /api/routes/{name}/targets                list the targets of a route
+//	POST   /api/routes/{name}/targets                add a target
+//	PUT    /api/routes/{name}/targets/{index}        change a target's weight or drain it
+//	DELETE /api/routes/{name}/targets/{index}        remove a target
+//	POST   /api/routes/{name}/targets/{index}/drain  stop sending new requests to a target
+//	DELETE /api/routes/{name}/targets/{index}/drain  send requests to the target again
+//	POST   /api/routes/{name}/maintenance            serve the maintenance page
+//	DELETE /api/routes/{name}/maintenance            end the maintenance
+//
+// Every response carries the version of the routing table in its ETag, and
+// changes with an If-Match header fail with 412 when the table has changed
+// since. With a config path, changes are written back to the config file.
+//
+// The files a route reads or writes can only be among the paths of the
+// routes in the config file, so that the API cannot be used to read or
+// overwrite arbitrary files of the proxy's host.
+type routesAPI struct {
+	router     *router
+	configPath string
+	paths      map[string]bool
+	mu         sync.Mutex
+}
+
+// newRoutesAPI returns the API for the router, allowing the file paths of
+// the routes the router started with.
+func newRoutesAPI(rt *router) *routesAPI {
+	api := &routesAPI{router: rt, paths: make(map[string]bool)}
+	for _, rc := range rt.table.Load().configs {
+		for _, p := range routePaths(rc) {
+			api.paths[p] = true
+		}
+	}
+	return api
+}
+
+func (api *routesAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/routes"), "/"), "/")
+	if parts[0] == "" {
+		parts = nil
+	}
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		table := api.router.table.Load()
+		configs := make([]routeConfig, len(table.configs))
+		for i, rc := range table.configs {
+			configs[i] = redactSecrets(rc)
+		}
+		api.write(w, table, map[string]any{"routes": configs})
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		var rc routeConfig
+		if !readJSON(w, r, &rc) {
+			return
+		}
+		index := -1
+		if s := r.URL.Query().Get("index"); s != "" {
+			if index, err = strconv.Atoi(s); err != nil || index < 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid index %q", s))
+				return
+			}
+		}
+		api.change(w, version, func(configs []routeConfig) ([]routeConfig, error) {
+			if indexOfRoute(configs, rc.Name) >= 0 {
+				return nil, errRouteExists
+			}
+			i := index
+			if i < 0 || i > len(configs) {
+				i = insertionIndex(configs, rc.Prefix)
+			}
+			return append(configs[:i], append([]routeConfig{rc}, configs[i:]...)...), nil
+		}, rc.Name)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		table := api.router.table.Load()
+		i := indexOfRoute(table.configs, parts[0])
+		if i < 0 {
+			writeError(w, http.StatusNotFound, errRouteNotFound)
+			return
+		}
+		api.write(w, table, map[string]any{"route": redactSecrets(table.configs[i])})
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		var rc routeConfig
+		if !readJSON(w, r, &rc) {
+			return
+		}
+		if rc.Name == "" {
+			rc.Name = parts[0]
+		}
+		api.change(w, version, func(configs []routeConfig) ([]routeConfig, error) {
+			i := indexOfRoute(configs, parts[0])
+			if i < 0 {
+				return nil, errRouteNotFound
+			}
+			configs[i] = restoreSecrets(rc, configs[i])
+			return configs, nil
+		}, rc.Name)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		api.change(w, version, func(configs []routeConfig) ([]routeConfig, error) {
+			i := indexOfRoute(configs, parts[0])
+			if i < 0 {
+				return nil, errRouteNotFound
+			}
+			return append(configs[:i], configs[i+1:]...), nil
+		}, "")
+	case len(parts) == 2 && parts[1] == "maintenance" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		on := r.Method == http.MethodPost
+		api.change(w, version, func(configs []routeConfig) ([]routeConfig, error) {
+			i := indexOfRoute(configs, parts[0])
+			if i < 0 {
+				return nil, errRouteNotFound
+			}
+			m := maintenanceConfig{}
+			if configs[i].Maintenance != nil {
+				m = *configs[i].Maintenance
+			}
+			m.Enabled = on
+			configs[i].Maintenance = &m
+			return configs, nil
+		}, parts[0])
+	case len(parts) >= 2 && parts[1] == "targets":
+		api.serveTargets(w, r, version, parts[0], parts[2:])
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (api *routesAPI) serveTargets(w http.ResponseWriter, r *http.Request, version uint64, name string, rest []string) {
+	index := -1
+	if len(rest) > 0 {
+		var err error
+		if index, err = strconv.Atoi(rest[0]); err != nil || index < 0 {
+			writeError(w, http.StatusNotFound, errTargetNotFound)
+			return
+		}
+	}
+	drain := len(rest) == 2 && rest[1] == "drain"
+	if len(rest) > 2 || len(rest) == 2 && !drain {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no %s %s", r.Method, r.URL.Path))
+		return
+	}
+	// changeTargets edits the targets of the route, turning a single
+	// upstream into a target list first.
+	changeTargets := func(change func([]targetConfig) ([]targetConfig, error)) {
+		api.change(w, version, func(configs []routeConfig) ([]routeConfig, error) {
+			i := indexOfRoute(configs, name)
+			if i < 0 {
+				return nil, errRouteNotFound
+			}
+			rc := configs[i]
+			targets := append([]targetConfig(nil), rc.Targets...)
+			if rc.Upstream != "" {
+				targets = []targetConfig{{URL: rc.Upstream}}
+			}
+			targets, err := change(targets)
+			if err != nil {
+				return nil, err
+			}
+			rc.Upstream, rc.Targets = "", targets
+			configs[i] = rc
+			return configs, nil
+		}, name)
+	}
+
+	switch {
+	case drain && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		changeTargets(func(targets []targetConfig) ([]targetConfig, error) {
+			if index >= len(targets) {
+				return nil, errTargetNotFound
+			}
+			targets[index].Drain = r.Method == http.MethodPost
+			return targets, nil
+		})
+	case drain:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no %s %s", r.Method, r.URL.Path))
+	case index < 0 && r.Method == http.MethodGet:
+		table := api.router.table.Load()
+		i := indexOfRoute(table.configs, name)
+		if i < 0 {
+			writeError(w, http.StatusNotFound, errRouteNotFound)
+			return
+		}
+		rc := table.configs[i]
+		targets := rc.Targets
+		if rc.Upstream != "" {
+			targets = []targetConfig{{URL: rc.Upstream}}
+		}
+		api.write(w, table, map[string]any{"targets": targets})
+	case index < 0 && r.Method == http.MethodPost:
+		var tc targetConfig
+		if !readJSON(w, r, &tc) {
+			return
+		}
+		changeTargets(func(targets []targetConfig) ([]targetConfig, error) {
+			return append(targets, tc), nil
+		})
+	case index >= 0 && r.Method == http.MethodPut:
+		var tc targetConfig
+		if !readJSON(w, r, &tc) {
+			return
+		}
+		changeTargets(func(targets []targetConfig) ([]targetConfig, error) {
+			if index >= len(targets) {
+				return nil, errTargetNotFound
+			}
+			targets[index] = tc
+			return targets, nil
+		})
+	case index >= 0 && r.Method == http.MethodDelete:
+		changeTargets(func(targets []targetConfig) ([]targetConfig, error) {
+			if index >= len(targets) {
+				return nil, errTargetNotFound
+			}
+			return append(targets[:index], targets[index+1:]...), nil
+		})
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// change updates the routing table and answers with the route called name,
+// or just the new version when name is empty.
+func (api *routesAPI) change(w http.ResponseWriter, version uint64, change func([]routeConfig) ([]routeConfig, error), name string) {
+	table, err := api.router.update(version, func(configs []routeConfig) ([]routeConfig, error) {
+		configs, err := change(configs)
+		if err != nil {
+			return nil, err
+		}
+		for _, rc := range configs {
+			for _, p := range routePaths(rc) {
+				if !api.paths[p] {
+					return nil, fmt.Errorf("%w: %s of route %s", errPathNotAllowed, p, rc.Name)
+				}
+			}
+		}
+		return configs, nil
+	})
+	switch {
+	case errors.Is(err, errVersionMismatch):
+		writeError(w, http.StatusPreconditionFailed, err)
+		return
+	case errors.Is(err, errPathNotAllowed):
+		writeError(w, http.StatusForbidden, err)
+		return
+	case errors.Is(err, errRouteNotFound), errors.Is(err, errTargetNotFound):
+		writeError(w, http.StatusNotFound, err)
+		return
+	case errors.Is(err, errRouteExists):
+		writeError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := api.persist(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("change applied but not saved: %v", err))
+		return
+	}
+	body := map[string]any{}
+	if i := indexOfRoute(table.configs, name); i >= 0 {
+		body["route"] = redactSecrets(table.configs[i])
+	}
+	api.write(w, table, body)
+}
+
+func (api *routesAPI) write(w http.ResponseWriter, table *routingTable, body map[string]any) {
+	body["version"] = table.version
+	w.Header().Set("ETag", fmt.Sprintf("%q", strconv.FormatUint(table.version, 10)))
+	writeJSON(w, http.StatusOK, body)
+}
+
+// persist writes the current routes into the routes of the config file,
+// leaving the other sections as they are.
+func (api *routesAPI) persist() error {
+	if api.configPath == "" {
+		return nil
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	data, err := os.ReadFile(api.configPath)
+	if err != nil {
+		return err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc["routes"], err = json.Marshal(api.router.table.Load().configs); err != nil {
+		return err
+	}
+	if data, err = json.MarshalIndent(doc, "", "  "); err != nil {
+		return err
+	}
+	info, err := os.Stat(api.configPath)
+	if err != nil {
+		return err
+	}
+	tmp := api.configPath + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, api.configPath)
+}
+
+// insertionIndex places a new route before the first route whose prefix
+// also matches the new prefix, so that the longer prefix wins.
+func insertionIndex(configs []routeConfig, prefix string) int {
+	for i, rc := range configs {
+		if strings.HasPrefix(prefix, rc.Prefix) {
+			return i
+		}
+	}
+	return len(configs)
+}
+
+// routePaths returns the files and directories the route reads or writes.
+func routePaths(rc routeConfig) []string {
+	var paths []string
+	add := func(p ...string) {
+		for _, p := range p {
+			if p != "" {
+				paths = append(paths, p)
+			}
+		}
+	}
+	if rc.Stub != nil {
+		add(rc.Stub.BodyFile)
+	}
+	if rc.Access != nil {
+		add(rc.Access.AllowFiles...)
+		add(rc.Access.DenyFiles...)
+		add(rc.Access.DenyTemplate)
+	}
+	if rc.Auth != nil {
+		add(rc.Auth.HtpasswdFile, rc.Auth.APIKeysFile)
+	}
+	if rc.JWT != nil {
+		add(rc.JWT.KeyFiles...)
+	}
+	if rc.Maintenance != nil {
+		add(rc.Maintenance.Page)
+	}
+	if rc.Capture != nil {
+		add(rc.Capture.Dir)
+	}
+	if rc.Mock != nil {
+		add(rc.Mock.Dir)
+	}
+	if rc.Shadow != nil {
+		add(rc.Shadow.ReportFile)
+	}
+	return paths
+}
+
+func ifMatchVersion(r *http.Request) (uint64, error) {
+	h := r.Header.Get("If-Match")
+	if h == "" || h == "*" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(strings.Trim(strings.TrimPrefix(h, "W/"), `"`), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid If-Match version %q", h)
+	}
+	return v, nil
+}
+
+// redactSecrets returns the route with its secrets replaced, for the API
+// output.
+func redactSecrets(rc routeConfig) routeConfig {
+	if rc.JWT != nil && rc.JWT.Secret != "" {
+		jwt := *rc.JWT
+		jwt.Secret = redacted
+		rc.JWT = &jwt
+	}
+	if rc.OIDC != nil {
+		oidc := *rc.OIDC
+		if oidc.ClientSecret != "" {
+			oidc.ClientSecret = redacted
+		}
+		if oidc.CookieSecret != "" {
+			oidc.CookieSecret = redacted
+		}
+		rc.OIDC = &oidc
+	}
+	if rc.SignedURL != nil && rc.SignedURL.Secret != "" {
+		signed := *rc.SignedURL
+		signed.Secret = redacted
+		rc.SignedURL = &signed
+	}
+	return rc
+}
+
+// restoreSecrets puts back the secrets of the old route which were left
+// redacted in a replacement read from the API output.
+func restoreSecrets(rc, old routeConfig) routeConfig {
+	if rc.JWT != nil && rc.JWT.Secret == redacted && old.JWT != nil {
+		rc.JWT.Secret = old.JWT.Secret
+	}
+	if rc.OIDC != nil && old.OIDC != nil {
+		if rc.OIDC.ClientSecret == redacted {
+			rc.OIDC.ClientSecret = old.OIDC.ClientSecret
+		}
+		if rc.OIDC.CookieSecret == redacted {
+			rc.OIDC.CookieSecret = old.OIDC.CookieSecret
+		}
+	}
+	if rc.SignedURL != nil && rc.SignedURL.Secret == redacted && old.SignedURL != nil {
+		rc.SignedURL.Secret = old.SignedURL.Secret
+	}
+	return rc
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("content type must be application/json"))
+		return false
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error parsing request: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestRoutesAPI(t *testing.T, routes []routeConfig) *routesAPI {
+	t.Helper()
+	rt, err := newRouter(&config{Routes: routes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRoutesAPI(rt)
+}
+
+func callRoutesAPI(api *routesAPI, method, path, ifMatch, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	return w
+}
+
+func routeNames(api *routesAPI) []string {
+	var names []string
+	for _, rc := range api.router.table.Load().configs {
+		names = append(names, rc.Name)
+	}
+	return names
+}
+
+func TestRoutesAPIIfMatch(t *testing.T) {
+	api := newTestRoutesAPI(t, []routeConfig{{Name: "go", Prefix: "/go", Stub: &stubConfig{Body: "go"}}})
+	w := callRoutesAPI(api, "GET", "/api/routes", "", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("list: %d, ETag %q", w.Code, etag)
+	}
+
+	if w := callRoutesAPI(api, "PUT", "/api/routes/go", etag, `{"prefix":"/go","stub":{"body":"one"}}`); w.Code != http.StatusOK {
+		t.Fatalf("change with the current version: %d %s", w.Code, w.Body)
+	}
+	w = callRoutesAPI(api, "PUT", "/api/routes/go", etag, `{"prefix":"/go","stub":{"body":"two"}}`)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("change with a stale version: %d %s, want 412", w.Code, w.Body)
+	}
+	if body := api.router.table.Load().configs[0].Stub.Body; body != "one" {
+		t.Errorf("stale change applied: body %q", body)
+	}
+	if w := callRoutesAPI(api, "DELETE", "/api/routes/go", `"x"`, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid If-Match: %d, want 400", w.Code)
+	}
+}
+
+func TestRoutesAPIInsertionOrder(t *testing.T) {
+	api := newTestRoutesAPI(t, []routeConfig{
+		{Name: "api", Prefix: "/api", Stub: &stubConfig{}},
+		{Name: "default", Prefix: "/", Stub: &stubConfig{}},
+	})
+	for _, tt := range []struct {
+		path, body string
+		want       string
+	}{
+		{"/api/routes", `{"name":"v2","prefix":"/api/v2","stub":{}}`, "v2 api default"},
+		{"/api/routes", `{"name":"static","prefix":"/static","stub":{}}`, "v2 api static default"},
+		{"/api/routes", `{"name":"v2-users","prefix":"/api/v2/users","stub":{}}`, "v2-users v2 api static default"},
+		{"/api/routes?index=0", `{"name":"first","prefix":"/","stub":{}}`, "first v2-users v2 api static default"},
+		{"/api/routes?index=5", `{"name":"health","prefix":"/health","stub":{}}`, "first v2-users v2 api static health default"},
+	} {
+		if w := callRoutesAPI(api, "POST", tt.path, "", tt.body); w.Code != http.StatusOK {
+			t.Fatalf("POST %s %s: %d %s", tt.path, tt.body, w.Code, w.Body)
+		}
+		if got := strings.Join(routeNames(api), " "); got != tt.want {
+			t.Errorf("after POST %s %s: routes %s, want %s", tt.path, tt.body, got, tt.want)
+		}
+	}
+	if w := callRoutesAPI(api, "POST", "/api/routes", "", `{"name":"api","prefix":"/x","stub":{}}`); w.Code != http.StatusConflict {
+		t.Errorf("duplicate name: %d, want 409", w.Code)
+	}
+}
+
+func TestRoutesAPIPaths(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "page.txt")
+	if err := os.WriteFile(page, []byte("page"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	api := newTestRoutesAPI(t, []routeConfig{{Name: "page", Prefix: "/page", Stub: &stubConfig{BodyFile: page}}})
+
+	stub, _ := json.Marshal(routeConfig{Prefix: "/copy", Stub: &stubConfig{BodyFile: page}})
+	if w := callRoutesAPI(api, "PUT", "/api/routes/page", "", string(stub)); w.Code != http.StatusOK {
+		t.Errorf("path of the config file: %d %s", w.Code, w.Body)
+	}
+	for _, tt := range []struct {
+		name string
+		rc   routeConfig
+	}{
+		{"stub body", routeConfig{Stub: &stubConfig{BodyFile: "/etc/passwd"}}},
+		{"deny template", routeConfig{Stub: &stubConfig{}, Access: &accessConfig{Deny: []string{"10.0.0.0/8"}, DenyTemplate: "/etc/passwd"}}},
+		{"maintenance page", routeConfig{Stub: &stubConfig{}, Maintenance: &maintenanceConfig{Page: "/etc/passwd"}}},
+		{"mock dir", routeConfig{Stub: &stubConfig{}, Mock: &mockConfig{Dir: filepath.Join(dir, "mocks")}}},
+		{"capture dir", routeConfig{Stub: &stubConfig{}, Capture: &captureConfig{Dir: filepath.Join(dir, "capture")}}},
+		{"shadow report", routeConfig{Stub: &stubConfig{}, Shadow: &shadowConfig{Upstream: "http://localhost:1", ReportFile: filepath.Join(dir, "report")}}},
+	} {
+		tt.rc.Name, tt.rc.Prefix = "evil", "/evil"
+		body, _ := json.Marshal(tt.rc)
+		if w := callRoutesAPI(api, "POST", "/api/routes", "", string(body)); w.Code != http.StatusForbidden {
+			t.Errorf("%s: POST %d %s, want 403", tt.name, w.Code, w.Body)
+		}
+		if w := callRoutesAPI(api, "PUT", "/api/routes/page", "", string(body)); w.Code != http.StatusForbidden {
+			t.Errorf("%s: PUT %d %s, want 403", tt.name, w.Code, w.Body)
+		}
+	}
+	if got := strings.Join(routeNames(api), " "); got != "page" {
+		t.Errorf("routes %s after the rejected changes", got)
+	}
+	for _, name := range []string{"mocks", "capture", "report"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s created by a rejected change", name)
+		}
+	}
+}
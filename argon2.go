@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2Verify checks password against an argon2id or argon2i hash in the
+// PHC string format, for example "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>".
+func argon2Verify(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[2] != "v=19" {
+		return false, errBadHash
+	}
+	key := argon2.IDKey
+	switch parts[1] {
+	case "argon2id":
+	case "argon2i":
+		key = argon2.Key
+	default:
+		return false, errBadHash
+	}
+
+	var memory, time, threads uint32
+	for _, param := range strings.Split(parts[3], ",") {
+		name, value, _ := strings.Cut(param, "=")
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || n == 0 {
+			return false, errBadHash
+		}
+		switch name {
+		case "m":
+			memory = uint32(n)
+		case "t":
+			time = uint32(n)
+		case "p":
+			threads = uint32(n)
+		default:
+			return false, errBadHash
+		}
+	}
+	if memory == 0 || time == 0 || threads == 0 || threads > 255 {
+		return false, errBadHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errBadHash
+	}
+	sum, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(sum) < 4 {
+		return false, errBadHash
+	}
+
+	derived := key([]byte(password), salt, time, memory, uint8(threads), uint32(len(sum)))
+	return subtle.ConstantTimeCompare(derived, sum) == 1, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+// The hashes were made with golang.org/x/crypto/argon2.
+var argon2Tests = []struct {
+	hash, password string
+}{
+	{"$argon2id$v=19$m=65536,t=3,p=4$c29tZXNhbHRzb21lc2FsdA$gduXp+Z6iReEolmbyHn5V8s1EtJzmEvZfYoY/Fn/AeI", "password"},
+	{"$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$gC0w3wrF7JDJ1HGZ646yww", "secret"},
+	{"$argon2i$v=19$m=4096,t=3,p=1$c29tZXNhbHRzb21lc2FsdA$iDoHsJkczCNRjwISH0IL7Bxa65e7yZ8nY0yRqC+7Odw", "password"},
+	{"$argon2i$v=19$m=256,t=2,p=2$c29tZXNhbHQ$mvYAkBw+ftKsdVwWDFpqhHwkKjS0Qbxf", ""},
+}
+
+func TestArgon2Verify(t *testing.T) {
+	for _, tt := range argon2Tests {
+		ok, err := argon2Verify(tt.hash, tt.password)
+		if err != nil || !ok {
+			t.Errorf("argon2Verify(%q, %q) = %v, %v, want true", tt.hash, tt.password, ok, err)
+		}
+		ok, err = argon2Verify(tt.hash, "x"+tt.password)
+		if err != nil || ok {
+			t.Errorf("argon2Verify(%q, %q) = %v, %v, want false", tt.hash, "x"+tt.password, ok, err)
+		}
+	}
+}
+
+func TestArgon2VerifyBadHash(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"$argon2id$v=16$m=64,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$gC0w3wrF7JDJ1HGZ646yww",
+		"$argon2x$v=19$m=64,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$gC0w3wrF7JDJ1HGZ646yww",
+		"$argon2id$v=19$m=64,t=0,p=1$c29tZXNhbHRzb21lc2FsdA$gC0w3wrF7JDJ1HGZ646yww",
+		"$argon2id$v=19$m=64,t=1,p=1,x=1$c29tZXNhbHRzb21lc2FsdA$gC0w3wrF7JDJ1HGZ646yww",
+		"$argon2id$v=19$m=64,t=1,p=1$!$gC0w3wrF7JDJ1HGZ646yww",
+	} {
+		if ok, err := argon2Verify(hash, "secret"); err == nil || ok {
+			t.Errorf("argon2Verify(%q) = %v, %v, want an error", hash, ok, err)
+		}
+	}
+}
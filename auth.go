@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type authConfig struct {
+	Realm           string `json:"realm"`
+	HtpasswdFile    string `json:"htpasswd_file"`
+	APIKeysFile     string `json:"api_keys_file"`
+	APIKeyHeader    string `json:"api_key_header"`
+	APIKeyQuery     string `json:"api_key_query"`
+	PrincipalHeader string `json:"principal_header"`
+}
+
+// authenticator checks HTTP Basic credentials against an htpasswd file
+// and API keys against a file of "principal:key" lines. Both files are
+// re-read on SIGHUP.
+type authenticator struct {
+	cfg         authConfig
+	credentials atomic.Pointer[credentials]
+
+	// verified caches successful password checks, because bcrypt and
+	// argon2 are deliberately slow.
+	verified sync.Map
+}
+
+type credentials struct {
+	users map[string]string
+	keys  []apiKey
+}
+
+type apiKey struct {
+	principal string
+	key       string
+}
+
+func newAuthenticator(cfg authConfig) (*authenticator, error) {
+	if cfg.HtpasswdFile == "" && cfg.APIKeysFile == "" {
+		return nil, fmt.Errorf("neither htpasswd_file nor api_keys_file is set")
+	}
+	if cfg.APIKeysFile != "" && cfg.APIKeyHeader == "" && cfg.APIKeyQuery == "" {
+		cfg.APIKeyHeader = "X-API-Key"
+	}
+	if cfg.PrincipalHeader == "" {
+		cfg.PrincipalHeader = "X-Auth-User"
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = "Restricted"
+	}
+	a := &authenticator{cfg: cfg}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *authenticator) load() error {
+	creds := &credentials{}
+	if a.cfg.HtpasswdFile != "" {
+		lines, err := readList(a.cfg.HtpasswdFile)
+		if err != nil {
+			return err
+		}
+		creds.users = make(map[string]string)
+		for _, line := range lines {
+			user, hash, found := strings.Cut(line, ":")
+			if !found {
+				return fmt.Errorf("%s: invalid line for user %q", a.cfg.HtpasswdFile, user)
+			}
+			creds.users[user] = hash
+		}
+	}
+	if a.cfg.APIKeysFile != "" {
+		lines, err := readList(a.cfg.APIKeysFile)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			principal, key, found := strings.Cut(line, ":")
+			if !found || key == "" {
+				return fmt.Errorf("%s: invalid line for principal %q", a.cfg.APIKeysFile, principal)
+			}
+			creds.keys = append(creds.keys, apiKey{principal, key})
+		}
+	}
+	a.credentials.Store(creds)
+	a.verified.Range(func(k, _ any) bool {
+		a.verified.Delete(k)
+		return true
+	})
+	return nil
+}
+
+func (a *authenticator) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := a.authenticate(r)
+		if !ok {
+			if a.cfg.HtpasswdFile != "" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.cfg.Realm))
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// The credentials are not passed upstream, only the principal.
+		r.Header.Del("Authorization")
+		if a.cfg.APIKeyHeader != "" {
+			r.Header.Del(a.cfg.APIKeyHeader)
+		}
+		if a.cfg.APIKeyQuery != "" {
+			q := r.URL.Query()
+			if q.Has(a.cfg.APIKeyQuery) {
+				q.Del(a.cfg.APIKeyQuery)
+				r.URL.RawQuery = q.Encode()
+			}
+		}
+		r.Header.Set(a.cfg.PrincipalHeader, principal)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *authenticator) authenticate(r *http.Request) (string, bool) {
+	creds := a.credentials.Load()
+	if creds.keys != nil {
+		key := ""
+		if a.cfg.APIKeyHeader != "" {
+			key = r.Header.Get(a.cfg.APIKeyHeader)
+		}
+		if key == "" && a.cfg.APIKeyQuery != "" {
+			key = r.URL.Query().Get(a.cfg.APIKeyQuery)
+		}
+		if key != "" {
+			principal := ""
+			for _, k := range creds.keys {
+				if subtle.ConstantTimeCompare([]byte(k.key), []byte(key)) == 1 {
+					principal = k.principal
+				}
+			}
+			return principal, principal != ""
+		}
+	}
+	if creds.users != nil {
+		if user, password, ok := r.BasicAuth(); ok {
+			if hash, found := creds.users[user]; found && a.verify(hash, password) {
+				return user, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (a *authenticator) verify(hash, password string) bool {
+	sum := sha256.Sum256([]byte(hash + "\x00" + password))
+	if _, found := a.verified.Load(sum); found {
+		return true
+	}
+	ok, err := verifyPassword(hash, password)
+	if err != nil || !ok {
+		return false
+	}
+	a.verified.Store(sum, struct{}{})
+	return true
+}
+
+// verifyPassword supports the bcrypt, argon2 and {SHA} htpasswd formats.
+func verifyPassword(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcryptVerify(hash, password)
+	case strings.HasPrefix(hash, "$argon2"):
+		return argon2Verify(hash, password)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		encoded := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(encoded), []byte(hash[5:])) == 1, nil
+	}
+	return false, fmt.Errorf("unsupported password hash")
+}
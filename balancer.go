@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+type targetConfig struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"`
+	Drain  bool   `json:"drain,omitempty"`
+}
+
+// target is one upstream server of a route.
+type target struct {
+	url      *url.URL
+	weight   int
+	drain    bool
+	current  int
+	inFlight *atomic.Int64
+}
+
+// newTargets returns the targets of the route, either its single upstream
+// or its list of weighted targets.
+func newTargets(rc routeConfig) ([]*target, error) {
+	configs := rc.Targets
+	if rc.Upstream != "" {
+		configs = []targetConfig{{URL: rc.Upstream}}
+	}
+	var targets []*target
+	for _, tc := range configs {
+		u, err := url.Parse(tc.URL)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %q", tc.URL)
+		}
+		if tc.Weight < 0 {
+			return nil, fmt.Errorf("negative weight of upstream %q", tc.URL)
+		}
+		weight := tc.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		targets = append(targets, &target{url: u, weight: weight, drain: tc.Drain, inFlight: new(atomic.Int64)})
+	}
+	return targets, nil
+}
+
+// balancer spreads the requests of a route over its targets with smooth
+// weighted round robin, skipping the draining targets.
+type balancer struct {
+	targets []*target
+	next    http.Handler
+	mu      sync.Mutex
+}
+
+func (b *balancer) pick() *target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var best *target
+	total := 0
+	for _, t := range b.targets {
+		if t.drain {
+			continue
+		}
+		t.current += t.weight
+		total += t.weight
+		if best == nil || t.current > best.current {
+			best = t
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+func (b *balancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t := b.pick()
+	if t == nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	t.inFlight.Add(1)
+	defer t.inFlight.Add(-1)
+	b.next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), targetKey, t)))
+}
+
+// adoptCounters makes the targets share the in-flight counters of the same
+// upstreams in a previous version of the route, so that the requests still
+// running there are counted, for example while a target is drained.
+func adoptCounters(targets, previous []*target) {
+	for _, t := range targets {
+		for _, p := range previous {
+			if t.url.String() == p.url.String() {
+				t.inFlight = p.inFlight
+			}
+		}
+	}
+}
+
+func targetOf(r *http.Request) *target {
+	return r.Context().Value(targetKey).(*target)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errBadHash = errors.New("malformed password hash")
+
+// bcryptVerify checks password against a "$2a$", "$2b$" or "$2y$" hash.
+func bcryptVerify(hash, password string) (bool, error) {
+	if len(hash) != 60 || hash[3] != '$' || hash[2] != 'a' && hash[2] != 'b' && hash[2] != 'y' {
+		return false, errBadHash
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+		return false, nil
+	}
+	return false, errBadHash
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+// The hashes are the crypt_blowfish test vectors and hashes made by
+// golang.org/x/crypto/bcrypt, which accepts all of them.
+var bcryptTests = []struct {
+	hash, password string
+}{
+	{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+	{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.VGOzA784oUp/Z0DY336zx7pLYAy0lwK", "U*U*"},
+	{"$2a$05$XXXXXXXXXXXXXXXXXXXXXOAcXxm9kjPGEMsLznoKqmqw7tc8WCx4a", "U*U*U"},
+	{"$2a$05$abcdefghijklmnopqrstuu5s2v8.iXieOjg/.AySBTTZIIVFJeBui", "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789chars after 72 are ignored"},
+	{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.7uG0VCzI2bS7j6ymqJi9CdcdxiRTWNy", ""},
+	{"$2b$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+	{"$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+	{"$2a$04$dFrnc3TCQVFEBxXU3mTi0.o3xTY1iUopkX449mBDic8akjnc2lCfu", "password"},
+	{"$2a$04$mePAue97yugINgv8FuXRVuYiiMGja2xcj9/zJ1OwjsQp4y9weJiWu", "correct horse battery staple"},
+}
+
+func TestBcryptVerify(t *testing.T) {
+	for _, tt := range bcryptTests {
+		ok, err := bcryptVerify(tt.hash, tt.password)
+		if err != nil || !ok {
+			t.Errorf("bcryptVerify(%q, %q) = %v, %v, want true", tt.hash, tt.password, ok, err)
+		}
+		ok, err = bcryptVerify(tt.hash, "x"+tt.password)
+		if err != nil || ok {
+			t.Errorf("bcryptVerify(%q, %q) = %v, %v, want false", tt.hash, "x"+tt.password, ok, err)
+		}
+	}
+}
+
+func TestBcryptVerifyBadHash(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"$2x$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a$5$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOe",
+		"$2a$05$CCCCCCCCCCCCCCCCCCCCC!E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+	} {
+		if ok, err := bcryptVerify(hash, "U*U"); err == nil || ok {
+			t.Errorf("bcryptVerify(%q) = %v, %v, want an error", hash, ok, err)
+		}
+	}
+}
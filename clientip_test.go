@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestWithClientIP(t *testing.T) {
+	trusted, err := parsePrefixes([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"no header", "203.0.113.9:1234", nil, "203.0.113.9"},
+		{"untrusted peer", "203.0.113.9:1234", []string{"198.51.100.1"}, "203.0.113.9"},
+		{"trusted peer", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted peer without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"spoofed leftmost hop", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"trusted hops skipped", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1, 10.0.0.3, 10.0.0.2"}, "198.51.100.1"},
+		{"several headers", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1", "10.0.0.2"}, "198.51.100.1"},
+		{"all hops trusted", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"invalid hop stops the walk", "10.0.0.1:1234", []string{"198.51.100.1, unknown, 10.0.0.2"}, "10.0.0.2"},
+		{"invalid last hop", "10.0.0.1:1234", []string{"198.51.100.1, unknown"}, "10.0.0.1"},
+		{"spaces and mapped addresses", "10.0.0.1:1234", []string{" 198.51.100.1 ,  ::ffff:10.0.0.2 "}, "198.51.100.1"},
+		{"IPv6 peer", "[::1]:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"mapped peer", "[::ffff:10.0.0.1]:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+	} {
+		var got netip.Addr
+		h := withClientIP(trusted, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = clientIP(r)
+		}))
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got.String() != tt.want {
+			t.Errorf("%s: client IP %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	for s, want := range map[string]string{
+		"192.0.2.1":            "192.0.2.1/32",
+		"192.0.2.77/24":        "192.0.2.0/24",
+		"::ffff:192.0.2.1":     "192.0.2.1/32",
+		"::ffff:192.0.2.0/120": "192.0.2.0/24",
+		"2001:db8::1":          "2001:db8::1/128",
+		"2001:db8::1/32":       "2001:db8::/32",
+	} {
+		p, err := parsePrefix(s)
+		if err != nil || p.String() != want {
+			t.Errorf("parsePrefix(%q) = %v, %v, want %s", s, p, err, want)
+		}
+	}
+	for _, s := range []string{"", "192.0.2", "192.0.2.1/33", "example.com"} {
+		if _, err := parsePrefix(s); err == nil {
+			t.Errorf("parsePrefix(%q) accepted", s)
+		}
+	}
+}
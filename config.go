@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+type config struct {
+	Server         serverConfig     `json:"server"`
+	Admin          *adminConfig     `json:"admin"`
+	TrustedProxies []string         `json:"trusted_proxies"`
+	RequestID      requestIDConfig  `json:"request_id"`
+	Access         *accessConfig    `json:"access"`
+	AccessLog      *accessLogConfig `json:"access_log"`
+	Tracing        *tracingConfig   `json:"tracing"`
+	WAFRules       []wafRule        `json:"waf_rules"`
+	Routes         []routeConfig    `json:"routes"`
+}
+
+type routeConfig struct {
+	Name            string                 `json:"name"`
+	Prefix          string                 `json:"prefix"`
+	Upstream        string                 `json:"upstream,omitempty"`
+	Targets         []targetConfig         `json:"targets,omitempty"`
+	StripPrefix     bool                   `json:"strip_prefix,omitempty"`
+	Stub            *stubConfig            `json:"stub,omitempty"`
+	Access          *accessConfig          `json:"access,omitempty"`
+	Auth            *authConfig            `json:"auth,omitempty"`
+	JWT             *jwtConfig             `json:"jwt,omitempty"`
+	OIDC            *oidcConfig            `json:"oidc,omitempty"`
+	ForwardAuth     *forwardAuthConfig     `json:"forward_auth,omitempty"`
+	SignedURL       *signedURLConfig       `json:"signed_url,omitempty"`
+	CORS            *corsConfig            `json:"cors,omitempty"`
+	SecurityHeaders *securityHeadersConfig `json:"security_headers,omitempty"`
+	WAF             *wafConfig             `json:"waf,omitempty"`
+	Maintenance     *maintenanceConfig     `json:"maintenance,omitempty"`
+	Capture         *captureConfig         `json:"capture,omitempty"`
+	Mock            *mockConfig            `json:"mock,omitempty"`
+	Faults          []faultConfig          `json:"faults,omitempty"`
+	Mirror          *mirrorConfig          `json:"mirror,omitempty"`
+	Shadow          *shadowConfig          `json:"shadow,omitempty"`
+}
+
+// defaultRoutes reproduce the hard coded routing of the original example
+// and are used when the config does not declare any routes.
+var defaultRoutes = []routeConfig{
+	{Name: "google", Prefix: "/google", Upstream: "https://google.com", StripPrefix: true},
+	{Name: "go", Prefix: "/go", Stub: &stubConfig{Body: "I'm Go!\r\n[{{.Path}}]\n", Template: true}},
+	{Name: "node", Prefix: "/node", Upstream: "http://localhost:9100"},
+	{Name: "default", Prefix: "/", Upstream: "http://localhost:9000"},
+}
+
+func loadConfig(path string) (*config, error) {
+	cfg := &config{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", path, err)
+		}
+	}
+	if len(cfg.Routes) == 0 {
+		cfg.Routes = defaultRoutes
+	}
+	return cfg, nil
+}
+
+// duration is a time.Duration written as a string like "1m30s" in the
+// config.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type corsConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           duration `json:"max_age"`
+	OverrideUpstream bool     `json:"override_upstream"`
+}
+
+// cors answers preflight requests at the proxy and adds the CORS headers
+// to the other responses. Origins are matched exactly, with "*" wildcards
+// ("https://*.example.com"), or as regular expressions prefixed with "~".
+type cors struct {
+	cfg      corsConfig
+	anyHost  bool
+	origins  []*regexp.Regexp
+	methods  string
+	headers  string
+	exposed  string
+	anyInput bool
+}
+
+func newCORS(cfg corsConfig) (*cors, error) {
+	c := &cors{cfg: cfg}
+	for _, origin := range cfg.AllowedOrigins {
+		var expr string
+		switch {
+		case origin == "*":
+			c.anyHost = true
+			continue
+		case strings.HasPrefix(origin, "~"):
+			expr = origin[1:]
+		default:
+			expr = "^" + strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(origin)), `\*`, `[^/]*`) + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin %q: %v", origin, err)
+		}
+		c.origins = append(c.origins, re)
+	}
+	if len(cfg.AllowedMethods) == 0 {
+		cfg.AllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	c.methods = strings.Join(cfg.AllowedMethods, ", ")
+	for _, h := range cfg.AllowedHeaders {
+		if h == "*" {
+			c.anyInput = true
+		}
+	}
+	c.headers = strings.Join(cfg.AllowedHeaders, ", ")
+	c.exposed = strings.Join(cfg.ExposedHeaders, ", ")
+	return c, nil
+}
+
+func (c *cors) allowed(origin string) bool {
+	if c.anyHost {
+		return true
+	}
+	for _, re := range c.origins {
+		if re.MatchString(strings.ToLower(origin)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cors) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+			if !c.allowed(origin) {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			c.setOrigin(w.Header(), origin)
+			w.Header().Set("Access-Control-Allow-Methods", c.methods)
+			if c.anyInput {
+				if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+					w.Header().Set("Access-Control-Allow-Headers", requested)
+				}
+			} else if c.headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", c.headers)
+			}
+			if c.cfg.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(c.cfg.MaxAge).Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if !c.allowed(origin) {
+			if !c.cfg.OverrideUpstream {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// The upstream must not grant what the policy denies.
+			next.ServeHTTP(&hookWriter{ResponseWriter: w, before: func(int) {
+				removeCORSHeaders(w.Header())
+				w.Header().Add("Vary", "Origin")
+			}}, r)
+			return
+		}
+		next.ServeHTTP(&hookWriter{ResponseWriter: w, before: func(int) {
+			h := w.Header()
+			if h.Get("Access-Control-Allow-Origin") != "" {
+				if !c.cfg.OverrideUpstream {
+					return
+				}
+				removeCORSHeaders(h)
+			}
+			c.setOrigin(h, origin)
+			if c.exposed != "" {
+				h.Set("Access-Control-Expose-Headers", c.exposed)
+			}
+			h.Add("Vary", "Origin")
+		}}, r)
+	})
+}
+
+func removeCORSHeaders(h http.Header) {
+	for k := range h {
+		if strings.HasPrefix(k, "Access-Control-") {
+			delete(h, k)
+		}
+	}
+}
+
+// setOrigin echoes the origin back, except for the "*" policy without
+// credentials, where the literal wildcard is enough.
+func (c *cors) setOrigin(h http.Header, origin string) {
+	if c.anyHost && !c.cfg.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if c.cfg.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSAllowed(t *testing.T) {
+	c, err := newCORS(corsConfig{AllowedOrigins: []string{
+		"https://app.example.com",
+		"https://*.example.org",
+		"http://localhost:*",
+		`~^https://[a-z]+\.example\.net$`,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for origin, want := range map[string]bool{
+		"https://app.example.com":       true,
+		"https://APP.example.com":       true,
+		"http://app.example.com":        false,
+		"https://app.example.com.evil":  false,
+		"https://evil.app.example.com":  false,
+		"https://a.example.org":         true,
+		"https://a.b.example.org":       true,
+		"https://example.org":           false,
+		"https://a.example.org.evil.io": false,
+		"https://evil.io/.example.org":  false,
+		"http://localhost:3000":         true,
+		"http://localhost":              false,
+		"https://api.example.net":       true,
+		"https://api2.example.net":      false,
+		"null":                          false,
+	} {
+		if got := c.allowed(origin); got != want {
+			t.Errorf("allowed(%q) = %v, want %v", origin, got, want)
+		}
+	}
+
+	wildcard, err := newCORS(corsConfig{AllowedOrigins: []string{"*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wildcard.allowed("https://anything.example") {
+		t.Error("origin not allowed by *")
+	}
+	if _, err := newCORS(corsConfig{AllowedOrigins: []string{"~("}}); err == nil {
+		t.Error("invalid origin expression accepted")
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		cfg     corsConfig
+		origin  string
+		headers string
+		status  int
+		want    map[string]string
+	}{
+		{
+			name:   "allowed",
+			cfg:    corsConfig{AllowedOrigins: []string{"https://app.example"}, AllowedMethods: []string{"GET", "PUT"}, AllowedHeaders: []string{"Content-Type"}, MaxAge: duration(10 * time.Minute)},
+			origin: "https://app.example", headers: "content-type",
+			status: http.StatusNoContent,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example",
+				"Access-Control-Allow-Methods":     "GET, PUT",
+				"Access-Control-Allow-Headers":     "Content-Type",
+				"Access-Control-Max-Age":           "600",
+				"Access-Control-Allow-Credentials": "",
+			},
+		},
+		{
+			name:   "default methods and any header",
+			cfg:    corsConfig{AllowedOrigins: []string{"*"}, AllowedHeaders: []string{"*"}},
+			origin: "https://app.example", headers: "x-custom, content-type",
+			status: http.StatusNoContent,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "*",
+				"Access-Control-Allow-Methods": "GET, HEAD, POST",
+				"Access-Control-Allow-Headers": "x-custom, content-type",
+				"Access-Control-Max-Age":       "",
+			},
+		},
+		{
+			name:   "credentials echo the origin",
+			cfg:    corsConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+			origin: "https://app.example",
+			status: http.StatusNoContent,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		},
+		{
+			name:   "disallowed",
+			cfg:    corsConfig{AllowedOrigins: []string{"https://app.example"}},
+			origin: "https://evil.example",
+			status: http.StatusForbidden,
+			want:   map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+	} {
+		c, err := newCORS(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := c.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("%s: preflight reached the upstream", tt.name)
+		}))
+		r := httptest.NewRequest("OPTIONS", "/api", nil)
+		r.Header.Set("Origin", tt.origin)
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+		if tt.headers != "" {
+			r.Header.Set("Access-Control-Request-Headers", tt.headers)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		for name, value := range tt.want {
+			if got := w.Header().Get(name); got != value {
+				t.Errorf("%s: %s = %q, want %q", tt.name, name, got, value)
+			}
+		}
+		if w.Header().Get("Vary") == "" {
+			t.Errorf("%s: no Vary", tt.name)
+		}
+	}
+}
+
+func TestCORSResponses(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		override bool
+		origin   string
+		upstream string
+		want     string
+	}{
+		{"allowed", false, "https://app.example", "", "https://app.example"},
+		{"allowed keeps the upstream grant", false, "https://app.example", "https://upstream.example", "https://upstream.example"},
+		{"allowed overrides the upstream grant", true, "https://app.example", "https://upstream.example", "https://app.example"},
+		{"disallowed", false, "https://evil.example", "", ""},
+		{"disallowed keeps the upstream grant", false, "https://evil.example", "https://evil.example", "https://evil.example"},
+		{"disallowed strips the upstream grant", true, "https://evil.example", "https://evil.example", ""},
+		{"no origin", true, "", "https://upstream.example", "https://upstream.example"},
+	} {
+		c, err := newCORS(corsConfig{AllowedOrigins: []string{"https://app.example"}, ExposedHeaders: []string{"X-Total"}, OverrideUpstream: tt.override})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := c.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.upstream != "" {
+				w.Header().Set("Access-Control-Allow-Origin", tt.upstream)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Write([]byte("ok"))
+		}))
+		r := httptest.NewRequest("GET", "/api", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "ok" {
+			t.Errorf("%s: response %d %q", tt.name, w.Code, w.Body)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", tt.name, got, tt.want)
+		}
+		if tt.want == "" && w.Header().Get("Access-Control-Allow-Credentials") != "" {
+			t.Errorf("%s: credentials allowed without an origin", tt.name)
+		}
+		if tt.want == "https://app.example" && w.Header().Get("Access-Control-Expose-Headers") != "X-Total" {
+			t.Errorf("%s: exposed headers = %q", tt.name, w.Header().Get("Access-Control-Expose-Headers"))
+		}
+		if tt.origin != "" && tt.override && w.Header().Get("Vary") != "Origin" {
+			t.Errorf("%s: Vary = %q, want Origin", tt.name, w.Header().Get("Vary"))
+		}
+	}
+}
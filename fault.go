@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+type faultConfig struct {
+	Percentage float64           `json:"percentage,omitempty"`
+	Header     string            `json:"header,omitempty"`
+	Delay      *faultDelayConfig `json:"delay,omitempty"`
+	Abort      int               `json:"abort,omitempty"`
+	Reset      bool              `json:"reset,omitempty"`
+	Bandwidth  int               `json:"bandwidth,omitempty"`
+}
+
+type faultDelayConfig struct {
+	Distribution string   `json:"distribution,omitempty"`
+	Duration     duration `json:"duration,omitempty"`
+	Min          duration `json:"min,omitempty"`
+	Max          duration `json:"max,omitempty"`
+	StdDev       duration `json:"stddev,omitempty"`
+}
+
+// faults injects failures into the requests of a route for resilience
+// testing. Every rule applies to a percentage of the requests, all of them
+// by default, and to the requests carrying its header when it has one. A
+// rule delays the request, then aborts it with a status, resets the client
+// connection, or throttles the response to a number of bytes per second.
+type faults struct {
+	route string
+	rules []faultConfig
+}
+
+func newFaults(route string, rules []faultConfig) (*faults, error) {
+	f := &faults{route: route}
+	for _, rule := range rules {
+		if rule.Percentage < 0 || rule.Percentage > 100 {
+			return nil, fmt.Errorf("invalid fault percentage %v", rule.Percentage)
+		}
+		if rule.Percentage == 0 {
+			rule.Percentage = 100
+		}
+		if rule.Abort != 0 && (rule.Abort < 200 || rule.Abort > 599) {
+			return nil, fmt.Errorf("invalid fault abort status %d", rule.Abort)
+		}
+		if rule.Bandwidth < 0 {
+			return nil, fmt.Errorf("negative fault bandwidth %d", rule.Bandwidth)
+		}
+		if d := rule.Delay; d != nil {
+			switch d.Distribution {
+			case "", "fixed", "normal", "exponential":
+			case "uniform":
+				if d.Max < d.Min {
+					return nil, fmt.Errorf("fault delay max %v below min %v", d.Max, d.Min)
+				}
+			default:
+				return nil, fmt.Errorf("unknown fault delay distribution %q", d.Distribution)
+			}
+		}
+		if rule.Delay == nil && rule.Abort == 0 && !rule.Reset && rule.Bandwidth == 0 {
+			return nil, fmt.Errorf("fault without a delay, abort, reset or bandwidth")
+		}
+		f.rules = append(f.rules, rule)
+	}
+	return f, nil
+}
+
+func (f *faults) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rule := range f.rules {
+			if rule.Header != "" && r.Header.Get(rule.Header) == "" || rand.Float64()*100 >= rule.Percentage {
+				continue
+			}
+			if rule.Delay != nil {
+				proxyMetrics.faults.add(1, f.route, "delay")
+				t := time.NewTimer(rule.Delay.sample())
+				select {
+				case <-t.C:
+				case <-r.Context().Done():
+					t.Stop()
+					return
+				}
+			}
+			switch {
+			case rule.Reset:
+				proxyMetrics.faults.add(1, f.route, "reset")
+				resetConnection(w)
+				return
+			case rule.Abort != 0:
+				proxyMetrics.faults.add(1, f.route, "abort")
+				w.Header().Set("X-Proxy-Fault", "abort")
+				http.Error(w, http.StatusText(rule.Abort), rule.Abort)
+				return
+			case rule.Bandwidth > 0:
+				proxyMetrics.faults.add(1, f.route, "bandwidth")
+				w = &throttledWriter{ResponseWriter: w, rate: rule.Bandwidth}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sample returns a delay drawn from the distribution: fixed at duration,
+// uniform between min and max, normal around duration with stddev, or
+// exponential with the mean duration.
+func (d *faultDelayConfig) sample() time.Duration {
+	var v float64
+	switch d.Distribution {
+	case "uniform":
+		v = float64(d.Min) + rand.Float64()*float64(d.Max-d.Min)
+	case "normal":
+		v = float64(d.Duration) + rand.NormFloat64()*float64(d.StdDev)
+	case "exponential":
+		v = rand.ExpFloat64() * float64(d.Duration)
+	default:
+		v = float64(d.Duration)
+	}
+	if v < 0 {
+		return 0
+	}
+	return time.Duration(v)
+}
+
+// resetConnection closes the client connection with a TCP reset, without
+// sending a response.
+func resetConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// throttledWriter sends the response body at rate bytes per second, in
+// chunks every tenth of a second.
+type throttledWriter struct {
+	http.ResponseWriter
+	rate int
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	chunk := w.rate / 10
+	if chunk == 0 {
+		chunk = 1
+	}
+	rc := http.NewResponseController(w.ResponseWriter)
+	written := 0
+	for written < len(b) {
+		n := len(b) - written
+		if n > chunk {
+			n = chunk
+		}
+		start := time.Now()
+		n, err := w.ResponseWriter.Write(b[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		rc.Flush()
+		time.Sleep(time.Duration(n)*time.Second/time.Duration(w.rate) - time.Since(start))
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
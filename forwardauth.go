@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+type forwardAuthConfig struct {
+	URL             string   `json:"url"`
+	Timeout         duration `json:"timeout"`
+	RequestHeaders  []string `json:"request_headers"`
+	ResponseHeaders []string `json:"response_headers"`
+}
+
+// forwardAuth asks an external service whether a request is allowed, the
+// same way as forward-auth in Traefik or auth_request in nginx.
+type forwardAuth struct {
+	cfg    forwardAuthConfig
+	client *http.Client
+}
+
+// hopHeaders are not copied into the authorization sub-request.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length",
+}
+
+func newForwardAuth(cfg forwardAuthConfig) (*forwardAuth, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = duration(5 * time.Second)
+	}
+	return &forwardAuth{
+		cfg: cfg,
+		client: &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+func (a *forwardAuth) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, header := range a.cfg.ResponseHeaders {
+			r.Header.Del(header)
+		}
+
+		resp, err := a.check(r)
+		if err != nil {
+			log.Printf("error calling forward auth %s for request %s: %v", a.cfg.URL, requestID(r), err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+			for _, h := range hopHeaders {
+				w.Header().Del(h)
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+		for _, header := range a.cfg.ResponseHeaders {
+			if v := resp.Header.Values(header); len(v) > 0 {
+				r.Header[http.CanonicalHeaderKey(header)] = v
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *forwardAuth) check(r *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(a.cfg.Timeout))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, a.cfg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.cfg.RequestHeaders) == 0 {
+		req.Header = r.Header.Clone()
+		for _, h := range hopHeaders {
+			req.Header.Del(h)
+		}
+	} else {
+		for _, h := range a.cfg.RequestHeaders {
+			if v := r.Header.Values(h); len(v) > 0 {
+				req.Header[http.CanonicalHeaderKey(h)] = v
+			}
+		}
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", clientIP(r).String())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// The body must be read before the timeout context is cancelled, for
+	// a denial to be relayed to the client and for the connection to the
+	// auth service to be kept alive.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestForwardAuth(t *testing.T) {
+	var conns atomic.Int32
+	service := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "denied", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-User", "alice")
+		io.WriteString(w, "allowed")
+	}))
+	service.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	service.Start()
+	defer service.Close()
+
+	a, err := newForwardAuth(forwardAuthConfig{URL: service.URL, ResponseHeaders: []string{"X-User"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "user "+r.Header.Get("X-User"))
+	}))
+
+	for i := 0; i < 5; i++ {
+		r := httptest.NewRequest("GET", "/app", nil)
+		r.Header.Set("Authorization", "Bearer good")
+		r.Header.Set("X-User", "mallory")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "user alice" {
+			t.Fatalf("allowed request: %d %q", w.Code, w.Body)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%d connections to the auth service, want 1", n)
+	}
+
+	r := httptest.NewRequest("GET", "/app", nil)
+	r.Header.Set("Authorization", "Bearer bad")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || w.Body.String() != "denied\n" || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("denied request: %d %q %v", w.Code, w.Body, w.Header())
+	}
+}
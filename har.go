@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type captureConfig struct {
+	Dir            string   `json:"dir"`
+	MaxBodySize    int      `json:"max_body_size,omitempty"`
+	MaxFileSize    int64    `json:"max_file_size,omitempty"`
+	MaxFiles       int      `json:"max_files,omitempty"`
+	RedactHeaders  []string `json:"redact_headers,omitempty"`
+	RedactCookies  []string `json:"redact_cookies,omitempty"`
+	KeepCookies    []string `json:"keep_cookies,omitempty"`
+	RedactQuery    []string `json:"redact_query,omitempty"`
+	AuthPaths      []string `json:"auth_paths,omitempty"`
+	KeepAuthBodies bool     `json:"keep_auth_bodies,omitempty"`
+}
+
+// defaultAuthPaths are the paths of the usual login and token endpoints,
+// whose bodies carry passwords and tokens.
+var defaultAuthPaths = []string{"/login", "/logout", "/signin", "/token", "/auth/*", "/oauth/*", "/oauth2/*", "/*/login", "/*/signin", "/*/token"}
+
+// harRecorder captures the requests of a route with their responses into
+// HAR 1.2 files, named after the route and the time they were started. A
+// file is closed when it would grow over max_file_size, and only the last
+// max_files are kept. The file being filled is rewritten at most once a
+// second, so it is always a complete HAR document. The bodies of the
+// requests to the auth_paths or with an Authorization header are left out
+// unless keep_auth_bodies is set.
+type harRecorder struct {
+	route   string
+	cfg     captureConfig
+	filter  *logFilter
+	mu      sync.Mutex
+	file    string
+	entries []json.RawMessage
+	size    int64
+	pending bool
+}
+
+func newHARRecorder(route string, cfg captureConfig) (*harRecorder, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("capture without a dir")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	if cfg.MaxBodySize == 0 {
+		cfg.MaxBodySize = 64 << 10
+	}
+	if cfg.MaxFileSize == 0 {
+		cfg.MaxFileSize = 10 << 20
+	}
+	if cfg.MaxFiles == 0 {
+		cfg.MaxFiles = 10
+	}
+	if cfg.AuthPaths == nil {
+		cfg.AuthPaths = defaultAuthPaths
+	}
+	for _, pattern := range cfg.AuthPaths {
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %v", pattern, err)
+		}
+	}
+	filter, err := newLogFilter(accessLogConfig{RedactHeaders: cfg.RedactHeaders, RedactCookies: cfg.RedactCookies, KeepCookies: cfg.KeepCookies, RedactQuery: cfg.RedactQuery})
+	if err != nil {
+		return nil, err
+	}
+	return &harRecorder{route: route, cfg: cfg, filter: filter}, nil
+}
+
+func (h *harRecorder) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqBody := &captureReader{ReadCloser: r.Body, limit: h.cfg.MaxBodySize}
+		if r.Body != nil {
+			r.Body = reqBody
+		}
+		reqHeader := r.Header.Clone()
+		cw := &captureWriter{statusWriter: statusWriter{ResponseWriter: w}, limit: h.cfg.MaxBodySize}
+		next.ServeHTTP(cw, r)
+
+		entry, err := json.Marshal(h.entry(r, reqHeader, reqBody, cw))
+		if err != nil {
+			return
+		}
+		h.add(entry)
+	})
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func (h *harRecorder) entry(r *http.Request, reqHeader http.Header, reqBody *captureReader, cw *captureWriter) map[string]any {
+	info := infoOf(r)
+	total := time.Since(info.start)
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	query := []harNameValue{}
+	for name, values := range r.URL.Query() {
+		for _, v := range values {
+			if h.filter.redactQuery[strings.ToLower(name)] {
+				v = redacted
+			}
+			query = append(query, harNameValue{name, v})
+		}
+	}
+	sort.Slice(query, func(i, j int) bool { return query[i].Name < query[j].Name })
+
+	request := map[string]any{
+		"method":      r.Method,
+		"url":         h.filter.uri(scheme + "://" + r.Host + r.URL.RequestURI()),
+		"httpVersion": r.Proto,
+		"cookies":     []any{},
+		"headers":     h.headers(reqHeader),
+		"queryString": query,
+		"headersSize": -1,
+		"bodySize":    reqBody.n,
+	}
+	omit := h.authRequest(r.URL.Path, reqHeader)
+	if reqBody.n > 0 {
+		postData := map[string]any{"mimeType": reqHeader.Get("Content-Type"), "text": ""}
+		mediaType, _, _ := mime.ParseMediaType(reqHeader.Get("Content-Type"))
+		switch {
+		case omit:
+			postData["comment"] = "omitted"
+		case mediaType == "application/x-www-form-urlencoded":
+			text := h.filter.query(reqBody.buf.String())
+			postData["text"] = text
+			postData["params"] = formParams(text)
+		default:
+			postData["text"], _ = harText(reqBody.buf.Bytes())
+		}
+		if !omit && reqBody.n > int64(reqBody.buf.Len()) {
+			postData["comment"] = "truncated"
+		}
+		request["postData"] = postData
+	}
+
+	content := map[string]any{"size": cw.bytes, "mimeType": cw.Header().Get("Content-Type")}
+	if omit && cw.buf.Len() > 0 {
+		content["comment"] = "omitted"
+	} else if cw.buf.Len() > 0 {
+		text, encoding := harText(cw.buf.Bytes())
+		content["text"] = text
+		if encoding != "" {
+			content["encoding"] = encoding
+		}
+		if cw.bytes > int64(cw.buf.Len()) {
+			content["comment"] = "truncated"
+		}
+	}
+	response := map[string]any{
+		"status":      cw.status(),
+		"statusText":  http.StatusText(cw.status()),
+		"httpVersion": r.Proto,
+		"cookies":     []any{},
+		"headers":     h.headers(cw.Header()),
+		"content":     content,
+		"redirectURL": cw.Header().Get("Location"),
+		"headersSize": -1,
+		"bodySize":    cw.bytes,
+	}
+
+	wait := info.upstreamLatency
+	if wait == 0 || wait > total {
+		wait = total
+	}
+	return map[string]any{
+		"startedDateTime": info.start.Format(time.RFC3339Nano),
+		"time":            milliseconds(total),
+		"request":         request,
+		"response":        response,
+		"cache":           map[string]any{},
+		"timings":         map[string]any{"send": 0, "wait": milliseconds(wait), "receive": milliseconds(total - wait)},
+		"comment":         "request " + info.requestID,
+	}
+}
+
+// headers lists the headers in the HAR form with the secrets redacted,
+// including the values of the redacted cookies in Set-Cookie.
+func (h *harRecorder) headers(header http.Header) []harNameValue {
+	list := []harNameValue{}
+	for _, name := range sortedKeys(header) {
+		for _, v := range header[name] {
+			switch {
+			case h.filter.redactHeaders[name]:
+				v = redacted
+			case name == "Cookie":
+				v = h.filter.cookies(v)
+			case name == "Set-Cookie":
+				cookie, attrs, _ := strings.Cut(v, ";")
+				if c := h.filter.cookies(cookie); c != cookie {
+					v = c
+					if attrs != "" {
+						v += ";" + attrs
+					}
+				}
+			case name == "Referer" || name == "Location":
+				v = h.filter.uri(v)
+			}
+			list = append(list, harNameValue{name, v})
+		}
+	}
+	return list
+}
+
+// authRequest reports whether the bodies of a request and its response
+// are left out, since they likely hold credentials or tokens.
+func (h *harRecorder) authRequest(p string, header http.Header) bool {
+	if h.cfg.KeepAuthBodies {
+		return false
+	}
+	if header.Get("Authorization") != "" {
+		return true
+	}
+	for _, pattern := range h.cfg.AuthPaths {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// formParams lists the parameters of a form body in the HAR form.
+func formParams(body string) []harNameValue {
+	params := []harNameValue{}
+	for _, param := range strings.Split(body, "&") {
+		if param == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+		params = append(params, harNameValue{name, value})
+	}
+	return params
+}
+
+// harText returns a body as text, or base64 encoded when it is binary.
+func harText(b []byte) (string, string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+func (h *harRecorder) add(entry json.RawMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file != "" && h.size+int64(len(entry)) > h.cfg.MaxFileSize {
+		h.write()
+		h.file, h.entries, h.size = "", nil, 0
+	}
+	if h.file == "" {
+		name := url.PathEscape(h.route) + "-" + time.Now().Format("20060102-150405.000") + ".har"
+		h.file = filepath.Join(h.cfg.Dir, name)
+		h.prune()
+	}
+	h.entries = append(h.entries, entry)
+	h.size += int64(len(entry))
+	if !h.pending {
+		h.pending = true
+		time.AfterFunc(time.Second, func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			h.pending = false
+			h.write()
+		})
+	}
+}
+
+func (h *harRecorder) write() {
+	if h.file == "" {
+		return
+	}
+	data, err := json.Marshal(map[string]any{
+		"log": map[string]any{
+			"version": "1.2",
+			"creator": map[string]string{"name": "go-reverse-proxy", "version": "1.0"},
+			"entries": h.entries,
+		},
+	})
+	if err == nil {
+		tmp := h.file + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, h.file)
+		}
+	}
+	if err != nil {
+		log.Printf("error writing %s: %v", h.file, err)
+	}
+}
+
+// prune removes the oldest capture files of the route, keeping room for
+// the new one.
+func (h *harRecorder) prune() {
+	files, _ := filepath.Glob(filepath.Join(h.cfg.Dir, url.PathEscape(h.route)+"-*.har"))
+	sort.Strings(files)
+	for len(files) >= h.cfg.MaxFiles {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+}
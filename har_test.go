@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// harEntry passes a request through a recorder and returns its entry.
+func harEntry(t *testing.T, h *harRecorder, r *http.Request, response string) map[string]any {
+	t.Helper()
+	reqBody := &captureReader{ReadCloser: r.Body, limit: h.cfg.MaxBodySize}
+	io.Copy(io.Discard, reqBody)
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/json")
+	cw := &captureWriter{statusWriter: statusWriter{ResponseWriter: w}, limit: h.cfg.MaxBodySize}
+	io.WriteString(cw, response)
+	return h.entry(r, r.Header.Clone(), reqBody, cw)
+}
+
+func TestHARFormRedaction(t *testing.T) {
+	h, err := newHARRecorder("test", captureConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/profile", strings.NewReader("user=alice&password=hunter2&note=a+b"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	entry := harEntry(t, h, r, `{"ok":true}`)
+
+	postData := entry["request"].(map[string]any)["postData"].(map[string]any)
+	if text := postData["text"]; text != "user=alice&password=REDACTED&note=a+b" {
+		t.Errorf("text = %q", text)
+	}
+	params := postData["params"].([]harNameValue)
+	want := []harNameValue{{"user", "alice"}, {"password", redacted}, {"note", "a b"}}
+	if len(params) != len(want) {
+		t.Fatalf("params = %v, want %v", params, want)
+	}
+	for i := range want {
+		if params[i] != want[i] {
+			t.Errorf("params[%d] = %v, want %v", i, params[i], want[i])
+		}
+	}
+	if text := entry["response"].(map[string]any)["content"].(map[string]any)["text"]; text != `{"ok":true}` {
+		t.Errorf("response text = %q", text)
+	}
+}
+
+func TestHARAuthBodies(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		cfg    captureConfig
+		path   string
+		header string
+		omit   bool
+	}{
+		{"login path", captureConfig{}, "/login", "", true},
+		{"nested token path", captureConfig{}, "/api/token", "", true},
+		{"oauth2 path", captureConfig{}, "/oauth2/token", "", true},
+		{"authorization header", captureConfig{}, "/api/items", "Bearer abc", true},
+		{"other path", captureConfig{}, "/api/items", "", false},
+		{"custom auth paths", captureConfig{AuthPaths: []string{"/session"}}, "/session", "", true},
+		{"custom auth paths replace the defaults", captureConfig{AuthPaths: []string{"/session"}}, "/login", "", false},
+		{"keep auth bodies", captureConfig{KeepAuthBodies: true}, "/login", "Bearer abc", false},
+	} {
+		tt.cfg.Dir = t.TempDir()
+		h, err := newHARRecorder("test", tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", tt.path, strings.NewReader(`{"password":"hunter2"}`))
+		r.Header.Set("Content-Type", "application/json")
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		entry := harEntry(t, h, r, `{"access_token":"secret"}`)
+		postData := entry["request"].(map[string]any)["postData"].(map[string]any)
+		content := entry["response"].(map[string]any)["content"].(map[string]any)
+		if omitted := postData["text"] == "" && content["text"] == nil; omitted != tt.omit {
+			t.Errorf("%s: bodies omitted = %v, want %v", tt.name, omitted, tt.omit)
+		}
+	}
+}
+
+func TestHARInvalidAuthPath(t *testing.T) {
+	if _, err := newHARRecorder("test", captureConfig{Dir: t.TempDir(), AuthPaths: []string{"/["}}); err == nil {
+		t.Error("invalid auth path accepted")
+	}
+}
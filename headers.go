@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+type securityHeadersConfig struct {
+	ContentSecurityPolicy   string `json:"content_security_policy"`
+	CSPReportOnly           bool   `json:"csp_report_only"`
+	CSPNonce                bool   `json:"csp_nonce"`
+	StrictTransportSecurity string `json:"strict_transport_security"`
+	ContentTypeOptions      string `json:"content_type_options"`
+	ReferrerPolicy          string `json:"referrer_policy"`
+	PermissionsPolicy       string `json:"permissions_policy"`
+	FrameOptions            string `json:"frame_options"`
+}
+
+// maxNonceBody is the largest HTML body buffered to inject CSP nonces.
+const maxNonceBody = 10 << 20
+
+// noncePlaceholder is put by the upstream application where the nonce goes
+// in its HTML, as in <script nonce="__CSP_NONCE__">. Only these are
+// replaced, so that tags injected into a page do not get the nonce.
+const noncePlaceholder = "__CSP_NONCE__"
+
+// securityHeaders adds the configured security headers to responses. A
+// "{nonce}" placeholder in the CSP is replaced with a fresh nonce per
+// response, and with csp_nonce the nonce also replaces the
+// noncePlaceholder in proxied HTML responses.
+type securityHeaders struct {
+	cfg securityHeadersConfig
+}
+
+func newSecurityHeaders(cfg securityHeadersConfig) *securityHeaders {
+	return &securityHeaders{cfg: cfg}
+}
+
+func (s *securityHeaders) apply(h http.Header, nonce string) {
+	set := func(name, value string) {
+		if value != "" {
+			h.Set(name, value)
+		}
+	}
+	csp := "Content-Security-Policy"
+	if s.cfg.CSPReportOnly {
+		csp = "Content-Security-Policy-Report-Only"
+	}
+	set(csp, strings.ReplaceAll(s.cfg.ContentSecurityPolicy, "{nonce}", nonce))
+	set("Strict-Transport-Security", s.cfg.StrictTransportSecurity)
+	set("X-Content-Type-Options", s.cfg.ContentTypeOptions)
+	set("Referrer-Policy", s.cfg.ReferrerPolicy)
+	set("Permissions-Policy", s.cfg.PermissionsPolicy)
+	set("X-Frame-Options", s.cfg.FrameOptions)
+}
+
+// rewrite asks the transport for an uncompressed response when nonces have
+// to be injected into the body.
+func (s *securityHeaders) rewrite(r *httputil.ProxyRequest) {
+	if s.cfg.CSPNonce {
+		r.Out.Header.Del("Accept-Encoding")
+	}
+}
+
+func (s *securityHeaders) modifyResponse(resp *http.Response) error {
+	nonce := randomString(16)
+	s.apply(resp.Header, nonce)
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !s.cfg.CSPNonce || mediaType != "text/html" || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	if resp.ContentLength > maxNonceBody {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxNonceBody+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxNonceBody {
+		resp.Body = prependBody(resp.Body, body)
+		return nil
+	}
+	resp.Body.Close()
+
+	body = bytes.ReplaceAll(body, []byte(noncePlaceholder), []byte(nonce))
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// wrap is used for the routes served by the proxy itself, where only the
+// headers are set.
+func (s *securityHeaders) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&hookWriter{ResponseWriter: w, before: func(int) {
+			s.apply(w.Header(), randomString(16))
+		}}, r)
+	})
+}
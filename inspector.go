@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inspector streams the finished requests to the admin clients watching
+// them. Requests are only captured while someone is watching.
+type inspector struct {
+	watchers atomic.Int32
+	mu       sync.Mutex
+	subs     map[*inspectSub]bool
+	filter   *logFilter
+}
+
+type inspectSub struct {
+	route   string
+	path    *regexp.Regexp
+	status  string
+	headers bool
+	body    int
+	events  chan []byte
+}
+
+type inspectEvent struct {
+	Time            time.Time         `json:"time"`
+	RequestID       string            `json:"request_id"`
+	ClientIP        string            `json:"client_ip"`
+	Method          string            `json:"method"`
+	URI             string            `json:"uri"`
+	Host            string            `json:"host"`
+	Route           string            `json:"route"`
+	Upstream        string            `json:"upstream,omitempty"`
+	Status          int               `json:"status"`
+	DurationMS      float64           `json:"duration_ms"`
+	RequestHeaders  map[string]string `json:"request_headers,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	RequestBody     string            `json:"request_body,omitempty"`
+	ResponseBody    string            `json:"response_body,omitempty"`
+}
+
+const maxInspectBody = 64 << 10
+
+var requestInspector = func() *inspector {
+	filter, _ := newLogFilter(accessLogConfig{})
+	return &inspector{subs: make(map[*inspectSub]bool), filter: filter}
+}()
+
+func (in *inspector) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if in.watchers.Load() == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limit := in.bodyLimit()
+		uri := r.URL.RequestURI()
+		reqBody := &captureReader{ReadCloser: r.Body, limit: limit}
+		if r.Body != nil && limit > 0 {
+			r.Body = reqBody
+		}
+		cw := &captureWriter{statusWriter: statusWriter{ResponseWriter: w}, limit: limit}
+		next.ServeHTTP(cw, r)
+
+		info := infoOf(r)
+		e := inspectEvent{
+			Time:       info.start,
+			RequestID:  info.requestID,
+			ClientIP:   clientIP(r).String(),
+			Method:     r.Method,
+			URI:        in.filter.uri(uri),
+			Host:       r.Host,
+			Route:      info.route,
+			Upstream:   info.upstream,
+			Status:     cw.status(),
+			DurationMS: milliseconds(time.Since(info.start)),
+		}
+		in.publish(r, &e, cw, reqBody)
+	})
+}
+
+func (in *inspector) bodyLimit() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	limit := 0
+	for sub := range in.subs {
+		if sub.body > limit {
+			limit = sub.body
+		}
+	}
+	return limit
+}
+
+func (in *inspector) publish(r *http.Request, e *inspectEvent, cw *captureWriter, reqBody *captureReader) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for sub := range in.subs {
+		if sub.route != "" && sub.route != e.Route || sub.path != nil && !sub.path.MatchString(r.URL.Path) || !matchStatus(sub.status, e.Status) {
+			continue
+		}
+		ev := *e
+		if sub.headers {
+			ev.RequestHeaders = in.filter.headers(r.Header, headerNames(r.Header))
+			ev.ResponseHeaders = in.filter.headers(cw.Header(), headerNames(cw.Header()))
+		}
+		if sub.body > 0 {
+			ev.RequestBody = truncate(reqBody.buf.Bytes(), sub.body)
+			ev.ResponseBody = truncate(cw.buf.Bytes(), sub.body)
+		}
+		data, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		select {
+		case sub.events <- data:
+		default:
+			// The watcher is too slow, so the event is dropped rather
+			// than holding up the request.
+		}
+	}
+}
+
+func headerNames(h http.Header) []string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	return names
+}
+
+func truncate(b []byte, n int) string {
+	if len(b) > n {
+		b = b[:n]
+	}
+	return string(b)
+}
+
+// ServeHTTP streams the matching requests as server-sent events. The query
+// parameters route, path (a regular expression) and status filter the
+// requests, headers=1 adds the headers and body=N up to N bytes of the
+// bodies.
+func (in *inspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sub := &inspectSub{route: q.Get("route"), status: q.Get("status"), headers: q.Get("headers") == "1", events: make(chan []byte, 256)}
+	if s := q.Get("path"); s != "" {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid path pattern: %v", err))
+			return
+		}
+		sub.path = re
+	}
+	if !validStatusPattern(sub.status) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid status pattern %q", sub.status))
+		return
+	}
+	if s := q.Get("body"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body size %q", s))
+			return
+		}
+		if n > maxInspectBody {
+			n = maxInspectBody
+		}
+		sub.body = n
+	}
+
+	in.mu.Lock()
+	in.subs[sub] = true
+	in.mu.Unlock()
+	in.watchers.Add(1)
+	defer func() {
+		in.watchers.Add(-1)
+		in.mu.Lock()
+		delete(in.subs, sub)
+		in.mu.Unlock()
+	}()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data := <-sub.events:
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		case <-ping.C:
+			io.WriteString(w, ": ping\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// captureReader keeps the first bytes read from a request body, and counts
+// all of them.
+type captureReader struct {
+	io.ReadCloser
+	limit int
+	buf   bytes.Buffer
+	n     int64
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	if room := r.limit - r.buf.Len(); room > 0 {
+		if room > n {
+			room = n
+		}
+		r.buf.Write(p[:room])
+	}
+	return n, err
+}
+
+// captureWriter keeps the first bytes of a response body.
+type captureWriter struct {
+	statusWriter
+	limit int
+	buf   bytes.Buffer
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	n, err := w.statusWriter.Write(b)
+	if room := w.limit - w.buf.Len(); room > 0 {
+		if room > n {
+			room = n
+		}
+		w.buf.Write(b[:room])
+	}
+	return n, err
+}
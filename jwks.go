@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type jwk struct {
+	kid string
+	key any
+}
+
+// keySet holds the keys used to verify JWT signatures: static keys from
+// PEM or JWKS files, an HMAC secret, and keys fetched from a JWKS URL.
+// The remote keys are refreshed periodically and when a token refers to
+// an unknown key ID.
+type keySet struct {
+	files  []string
+	secret string
+	static atomic.Pointer[[]jwk]
+
+	url      string
+	refresh  time.Duration
+	mu       sync.Mutex
+	remote   []jwk
+	fetched  time.Time
+	fetching bool
+}
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+func newKeySet(files []string, secret, url string, refresh time.Duration) (*keySet, error) {
+	if len(files) == 0 && secret == "" && url == "" {
+		return nil, fmt.Errorf("no keys configured")
+	}
+	if refresh <= 0 {
+		refresh = time.Hour
+	}
+	s := &keySet{files: files, secret: secret, url: url, refresh: refresh}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *keySet) load() error {
+	var keys []jwk
+	if s.secret != "" {
+		keys = append(keys, jwk{key: []byte(s.secret)})
+	}
+	for _, name := range s.files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		parsed, err := parseKeys(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		keys = append(keys, parsed...)
+	}
+	s.static.Store(&keys)
+	return nil
+}
+
+// lookup returns the candidate keys for a key ID. Keys without an ID match
+// any token.
+func (s *keySet) lookup(kid string) []any {
+	var keys []any
+	match := func(list []jwk) {
+		for _, k := range list {
+			if kid == "" || k.kid == "" || k.kid == kid {
+				keys = append(keys, k.key)
+			}
+		}
+	}
+	if static := s.static.Load(); static != nil {
+		match(*static)
+	}
+	if s.url != "" {
+		match(s.remoteKeys(kid))
+	}
+	return keys
+}
+
+// remoteKeys returns the keys fetched from the JWKS URL, fetching them
+// again when they are old or do not have the key ID. Only one request
+// fetches them at a time, without holding the lock, and the others go on
+// with the keys they have meanwhile.
+func (s *keySet) remoteKeys(kid string) []jwk {
+	s.mu.Lock()
+	age := time.Since(s.fetched)
+	fetch := !s.fetching && (age > s.refresh || (age > time.Minute && !hasKid(s.remote, kid)))
+	if fetch {
+		s.fetching = true
+	}
+	remote := s.remote
+	s.mu.Unlock()
+	if !fetch {
+		return remote
+	}
+
+	keys, err := fetchJWKS(s.url)
+	if err != nil {
+		log.Printf("error fetching JWKS from %s: %v", s.url, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.remote = keys
+	}
+	s.fetched = time.Now()
+	s.fetching = false
+	return s.remote
+}
+
+func hasKid(keys []jwk, kid string) bool {
+	for _, k := range keys {
+		if k.kid == kid {
+			return true
+		}
+	}
+	return kid == ""
+}
+
+func fetchJWKS(url string) ([]jwk, error) {
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var set jwksDocument
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	return set.parse()
+}
+
+// parseKeys accepts PEM encoded public keys and certificates, or a JWKS
+// document.
+func parseKeys(data []byte) ([]jwk, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var set jwksDocument
+		if err := json.Unmarshal(trimmed, &set); err != nil {
+			return nil, err
+		}
+		return set.parse()
+	}
+
+	var keys []jwk
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, jwk{key: key})
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, jwk{key: cert.PublicKey})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found")
+	}
+	return keys, nil
+}
+
+type jwksDocument struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+		K   string `json:"k"`
+	} `json:"keys"`
+}
+
+func (d *jwksDocument) parse() ([]jwk, error) {
+	var keys []jwk
+	for _, k := range d.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		var key any
+		var err error
+		switch k.Kty {
+		case "RSA":
+			var n, e *big.Int
+			if n, err = decodeBigInt(k.N); err == nil {
+				if e, err = decodeBigInt(k.E); err == nil {
+					key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+				}
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			var x, y *big.Int
+			if x, err = decodeBigInt(k.X); err == nil {
+				if y, err = decodeBigInt(k.Y); err == nil {
+					key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+				}
+			}
+		case "OKP":
+			if k.Crv != "Ed25519" {
+				continue
+			}
+			var x []byte
+			if x, err = base64.RawURLEncoding.DecodeString(k.X); err == nil {
+				if len(x) == ed25519.PublicKeySize {
+					key = ed25519.PublicKey(x)
+				} else {
+					err = fmt.Errorf("Ed25519 key of %d bytes", len(x))
+				}
+			}
+		case "oct":
+			var secret []byte
+			if secret, err = base64.RawURLEncoding.DecodeString(k.K); err == nil {
+				key = secret
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %v", k.Kid, err)
+		}
+		keys = append(keys, jwk{kid: k.Kid, key: key})
+	}
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
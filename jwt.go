@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type jwtConfig struct {
+	KeyFiles      []string            `json:"key_files"`
+	Secret        string              `json:"secret"`
+	JWKSURL       string              `json:"jwks_url"`
+	JWKSRefresh   duration            `json:"jwks_refresh"`
+	Issuer        string              `json:"issuer"`
+	Audience      []string            `json:"audience"`
+	Leeway        duration            `json:"leeway"`
+	RequireExp    *bool               `json:"require_exp,omitempty"`
+	RequireClaims map[string][]string `json:"require_claims"`
+	ForwardClaims map[string]string   `json:"forward_claims"`
+}
+
+type jwtClaims map[string]any
+
+type jwtVerifier struct {
+	keys       *keySet
+	issuer     string
+	audience   []string
+	leeway     time.Duration
+	requireExp bool
+}
+
+func newJWTVerifier(cfg jwtConfig) (*jwtVerifier, error) {
+	keys, err := newKeySet(cfg.KeyFiles, cfg.Secret, cfg.JWKSURL, time.Duration(cfg.JWKSRefresh))
+	if err != nil {
+		return nil, err
+	}
+	return &jwtVerifier{
+		keys:       keys,
+		issuer:     cfg.Issuer,
+		audience:   cfg.Audience,
+		leeway:     time.Duration(cfg.Leeway),
+		requireExp: cfg.RequireExp == nil || *cfg.RequireExp,
+	}, nil
+}
+
+// verify checks the signature and the registered time, issuer and
+// audience claims of a compact serialized JWS token. A token without exp
+// would stay valid forever and is rejected unless require_exp is false.
+func (v *jwtVerifier) verify(token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %v", err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range v.keys.lookup(header.Kid) {
+		if verifySignature(header.Alg, key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok && v.requireExp {
+		return nil, errors.New("token has no expiry")
+	}
+	if ok && now.After(time.Unix(int64(exp), 0).Add(v.leeway)) {
+		return nil, errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return nil, errors.New("unexpected issuer")
+	}
+	if len(v.audience) > 0 && !claims.hasAny("aud", v.audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	return claims, nil
+}
+
+// values returns a claim as a list of strings. Arrays are flattened and
+// strings are split on spaces, so that "scope" claims work as expected.
+func (c jwtClaims) values(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var values []string
+		for _, x := range v {
+			if s, ok := x.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	case float64, bool:
+		return []string{fmt.Sprint(v)}
+	}
+	return nil
+}
+
+func (c jwtClaims) hasAny(name string, allowed []string) bool {
+	for _, v := range c.values(name) {
+		for _, a := range allowed {
+			if v == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifySignature(alg string, key any, signed, signature []byte) bool {
+	if alg == "EdDSA" {
+		k, ok := key.(ed25519.PublicKey)
+		return ok && len(k) == ed25519.PublicKeySize && ed25519.Verify(k, signed, signature)
+	}
+	if len(alg) != 5 {
+		return false
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(k, hash, digest, signature, nil) == nil
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 2*((k.Curve.Params().BitSize+7)/8) {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:len(signature)/2])
+		s := new(big.Int).SetBytes(signature[len(signature)/2:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+// jwtAuth requires a valid bearer token, enforces the claim rules and
+// passes the selected claims upstream as headers.
+type jwtAuth struct {
+	verifier *jwtVerifier
+	require  map[string][]string
+	forward  map[string]string
+}
+
+func newJWTAuth(cfg jwtConfig) (*jwtAuth, error) {
+	verifier, err := newJWTVerifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtAuth{verifier: verifier, require: cfg.RequireClaims, forward: cfg.ForwardClaims}, nil
+}
+
+func (a *jwtAuth) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, header := range a.forward {
+			r.Header.Del(header)
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims, err := a.verifier.verify(strings.TrimSpace(token))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=\"invalid_token\", error_description=%q", err.Error()))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		for claim, allowed := range a.require {
+			if !claims.hasAny(claim, allowed) {
+				w.Header().Set("WWW-Authenticate", "Bearer error=\"insufficient_scope\"")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		for claim, header := range a.forward {
+			if values := claims.values(claim); len(values) > 0 {
+				r.Header.Set(header, strings.Join(values, " "))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type sampleRule struct {
+	Status string  `json:"status"`
+	Route  string  `json:"route"`
+	Rate   float64 `json:"rate"`
+}
+
+const redacted = "REDACTED"
+
+var (
+	defaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "X-API-Key"}
+	defaultRedactQuery   = []string{"token", "access_token", "id_token", "refresh_token", "password", "passwd", "secret", "api_key", "apikey", "signature"}
+)
+
+// logFilter decides which requests are written to the access log, and
+// removes secrets from what is written.
+type logFilter struct {
+	sample        []sampleRule
+	exclude       []string
+	redactHeaders map[string]bool
+	redactCookies map[string]bool
+	keepCookies   map[string]bool
+	redactQuery   map[string]bool
+}
+
+func newLogFilter(cfg accessLogConfig) (*logFilter, error) {
+	f := &logFilter{sample: cfg.Sample, exclude: cfg.ExcludePaths}
+	for _, rule := range cfg.Sample {
+		if !validStatusPattern(rule.Status) {
+			return nil, fmt.Errorf("invalid status pattern %q", rule.Status)
+		}
+		if rule.Rate < 0 || rule.Rate > 1 {
+			return nil, fmt.Errorf("sample rate %v is not between 0 and 1", rule.Rate)
+		}
+	}
+	for _, pattern := range cfg.ExcludePaths {
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %v", pattern, err)
+		}
+	}
+
+	if cfg.RedactHeaders == nil {
+		cfg.RedactHeaders = defaultRedactHeaders
+	}
+	if cfg.RedactQuery == nil {
+		cfg.RedactQuery = defaultRedactQuery
+	}
+	// Any cookie may hold a session, so all of them are redacted unless
+	// told otherwise.
+	if cfg.RedactCookies == nil {
+		cfg.RedactCookies = []string{"*"}
+	}
+	f.redactHeaders = nameSet(cfg.RedactHeaders, http.CanonicalHeaderKey)
+	f.redactCookies = nameSet(cfg.RedactCookies, func(s string) string { return s })
+	f.keepCookies = nameSet(cfg.KeepCookies, func(s string) string { return s })
+	f.redactQuery = nameSet(cfg.RedactQuery, strings.ToLower)
+	return f, nil
+}
+
+func nameSet(names []string, canonical func(string) string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range names {
+		set[canonical(name)] = true
+	}
+	return set
+}
+
+// excluded reports whether the path matches one of the excluded patterns,
+// such as health checks.
+func (f *logFilter) excluded(p string) bool {
+	for _, pattern := range f.exclude {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sampled applies the first sample rule matching the response. Responses
+// without a matching rule are always logged.
+func (f *logFilter) sampled(route string, status int) bool {
+	for _, rule := range f.sample {
+		if rule.Route != "" && rule.Route != route {
+			continue
+		}
+		if matchStatus(rule.Status, status) {
+			return rule.Rate >= 1 || rand.Float64() < rule.Rate
+		}
+	}
+	return true
+}
+
+func validStatusPattern(pattern string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	if len(pattern) != 3 || pattern[0] < '1' || pattern[0] > '5' {
+		return false
+	}
+	if strings.ToLower(pattern[1:]) == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(pattern)
+	return err == nil
+}
+
+// matchStatus matches a status against "*", a class like "2xx", or an
+// exact code like "404".
+func matchStatus(pattern string, status int) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	s := strconv.Itoa(status)
+	if strings.ToLower(pattern[1:]) == "xx" {
+		return s[0] == pattern[0]
+	}
+	return s == pattern
+}
+
+// uri redacts the sensitive query parameters, keeping their order.
+func (f *logFilter) uri(uri string) string {
+	base, query, found := strings.Cut(uri, "?")
+	if !found || len(f.redactQuery) == 0 {
+		return uri
+	}
+	return base + "?" + f.query(query)
+}
+
+// query redacts the sensitive parameters of a query string or a form body.
+func (f *logFilter) query(query string) string {
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if f.redactQuery[strings.ToLower(name)] {
+			params[i] = url.QueryEscape(name) + "=" + redacted
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// headers returns the selected request headers with the sensitive values
+// and cookies redacted.
+func (f *logFilter) headers(h http.Header, names []string) map[string]string {
+	if len(names) == 0 {
+		return nil
+	}
+	selected := make(map[string]string)
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		values := h.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		value := strings.Join(values, ", ")
+		switch {
+		case f.redactHeaders[name]:
+			value = redacted
+		case name == "Cookie":
+			value = f.cookies(value)
+		case name == "Referer":
+			value = f.uri(value)
+		}
+		selected[name] = value
+	}
+	return selected
+}
+
+func (f *logFilter) cookies(header string) string {
+	cookies := strings.Split(header, ";")
+	for i, c := range cookies {
+		name, _, _ := strings.Cut(strings.TrimSpace(c), "=")
+		if f.redactCookies["*"] && !f.keepCookies[name] || f.redactCookies[name] {
+			cookies[i] = " " + name + "=" + redacted
+		}
+	}
+	return strings.TrimSpace(strings.Join(cookies, ";"))
+}
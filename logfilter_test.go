@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLogFilterCookies(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  accessLogConfig
+		want string
+	}{
+		{"default", accessLogConfig{}, "proxy_session=REDACTED; lang=REDACTED"},
+		{"keep", accessLogConfig{KeepCookies: []string{"lang"}}, "proxy_session=REDACTED; lang=en"},
+		{"listed", accessLogConfig{RedactCookies: []string{"proxy_session"}}, "proxy_session=REDACTED; lang=en"},
+		{"none", accessLogConfig{RedactCookies: []string{}}, "proxy_session=abc; lang=en"},
+	} {
+		f, err := newLogFilter(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.cookies("proxy_session=abc; lang=en"); got != tt.want {
+			t.Errorf("%s: cookies = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLogFilterHeaders(t *testing.T) {
+	f, err := newLogFilter(accessLogConfig{KeepCookies: []string{"lang"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.Header{
+		"Authorization": {"Bearer abc"},
+		"X-Api-Key":     {"key"},
+		"Cookie":        {"id=1; lang=en"},
+		"Referer":       {"https://example.com/?token=abc&page=2"},
+		"Accept":        {"text/html"},
+	}
+	got := f.headers(h, []string{"authorization", "X-API-Key", "Cookie", "Referer", "Accept", "X-Missing"})
+	want := map[string]string{
+		"Authorization": redacted,
+		"X-Api-Key":     redacted,
+		"Cookie":        "id=REDACTED; lang=en",
+		"Referer":       "https://example.com/?token=REDACTED&page=2",
+		"Accept":        "text/html",
+	}
+	if len(got) != len(want) {
+		t.Errorf("headers = %v, want %v", got, want)
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %q, want %q", name, got[name], value)
+		}
+	}
+}
+
+func TestLogFilterURI(t *testing.T) {
+	f, err := newLogFilter(accessLogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for uri, want := range map[string]string{
+		"/path":                            "/path",
+		"/path?page=2":                     "/path?page=2",
+		"/path?Access_Token=abc&page=2":    "/path?Access_Token=REDACTED&page=2",
+		"/path?page=2&password=x&password": "/path?page=2&password=REDACTED&password=REDACTED",
+		"/path?api%5Fkey=abc":              "/path?api_key=REDACTED",
+	} {
+		if got := f.uri(uri); got != want {
+			t.Errorf("uri(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
+
+func TestLogFilterSampling(t *testing.T) {
+	f, err := newLogFilter(accessLogConfig{
+		Sample: []sampleRule{
+			{Status: "5xx", Rate: 1},
+			{Route: "api", Status: "404", Rate: 1},
+			{Route: "api", Status: "2xx", Rate: 0},
+			{Status: "*", Rate: 0},
+		},
+		ExcludePaths: []string{"/health", "/static/*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		route  string
+		status int
+		want   bool
+	}{
+		{"api", 503, true},
+		{"web", 500, true},
+		{"api", 404, true},
+		{"web", 404, false},
+		{"api", 200, false},
+		{"web", 200, false},
+	} {
+		if got := f.sampled(tt.route, tt.status); got != tt.want {
+			t.Errorf("sampled(%s, %d) = %v, want %v", tt.route, tt.status, got, tt.want)
+		}
+	}
+	for p, want := range map[string]bool{"/health": true, "/static/app.js": true, "/static/js/app.js": false, "/api": false} {
+		if got := f.excluded(p); got != want {
+			t.Errorf("excluded(%s) = %v, want %v", p, got, want)
+		}
+	}
+
+	unsampled, err := newLogFilter(accessLogConfig{Sample: []sampleRule{{Route: "api", Status: "2xx", Rate: 0}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unsampled.sampled("web", 200) {
+		t.Error("response without a matching rule not logged")
+	}
+}
+
+func TestLogFilterInvalid(t *testing.T) {
+	for _, cfg := range []accessLogConfig{
+		{Sample: []sampleRule{{Status: "6xx", Rate: 1}}},
+		{Sample: []sampleRule{{Status: "20", Rate: 1}}},
+		{Sample: []sampleRule{{Status: "2x0", Rate: 1}}},
+		{Sample: []sampleRule{{Status: "200", Rate: 1.5}}},
+		{ExcludePaths: []string{"/["}},
+	} {
+		if _, err := newLogFilter(cfg); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
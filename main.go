@@ -3,55 +3,129 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
 func main() {
-	defaultURL, err := url.Parse("http://localhost:9000")
-	if err != nil {
-		log.Fatal(fmt.Errorf("error parsing default URL: %v", err))
+	if len(os.Args) > 1 && os.Args[1] == "sign-url" {
+		signURLCommand(os.Args[2:])
+		return
 	}
 
-	nodeURL, err := url.Parse("http://localhost:9100")
+	cfg, err := loadConfig(os.Getenv("CONFIG"))
 	if err != nil {
-		log.Fatal(fmt.Errorf("error parsing node URL: %v", err))
+		log.Fatal(fmt.Errorf("error loading config: %v", err))
 	}
 
-	googleURL, err := url.Parse("https://google.com")
+	rt, err := newRouter(cfg)
 	if err != nil {
-		log.Fatal(fmt.Errorf("error parsing google's URL: %v", err))
+		log.Fatal(err)
+	}
+	handler, err := newHandler(cfg, rt)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if q, found := strings.CutPrefix(r.URL.Path, "/google"); found {
-			proxy := &httputil.ReverseProxy{
-				Rewrite: func(r *httputil.ProxyRequest) {
-					r.SetURL(googleURL)
-					r.Out.URL.Path = "/" + q
-				},
-			}
-			proxy.ServeHTTP(w, r)
-			return
-		}
-		if strings.HasPrefix(r.URL.Path, "/go") {
-			w.Write([]byte(fmt.Sprintf("I'm Go!\r\n[%v]\n", r.URL.Path)))
-			return
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload()
+			rt.reload()
 		}
-		if strings.HasPrefix(r.URL.Path, "/node") {
-			httputil.NewSingleHostReverseProxy(nodeURL).ServeHTTP(w, r)
-			return
+	}()
+	usr := make(chan os.Signal, 1)
+	signal.Notify(usr, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range usr {
+			if err := rt.setMaintenance(sig == syscall.SIGUSR1); err != nil {
+				log.Printf("error switching maintenance: %v", err)
+			}
 		}
-		httputil.NewSingleHostReverseProxy(defaultURL).ServeHTTP(w, r)
-	})
+	}()
+
+	if cfg.Admin != nil {
+		go serveAdmin(*cfg.Admin, rt, os.Getenv("CONFIG"))
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8000"
 	}
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln = newLimitListener(ln, cfg.Server.MaxConnections, cfg.Server.MaxConnectionsPerIP)
+	if err := newServer(cfg.Server, handler).Serve(ln); err != nil {
 		log.Fatal(err)
 	}
 }
+
+func newHandler(cfg *config, rt *router) (http.Handler, error) {
+	trusted, err := parsePrefixes(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing trusted proxies: %v", err)
+	}
+
+	var handler http.Handler = rt
+	if cfg.Access != nil {
+		access, err := newAccessList(cfg.Access)
+		if err != nil {
+			return nil, fmt.Errorf("error loading global access rules: %v", err)
+		}
+		onReload(access.load)
+		handler = access.wrap(handler)
+	}
+	if cfg.AccessLog != nil {
+		accessLog, err := newAccessLog(*cfg.AccessLog)
+		if err != nil {
+			return nil, fmt.Errorf("error opening access log: %v", err)
+		}
+		handler = accessLog.wrap(handler)
+	}
+	handler = withMetrics(requestInspector.wrap(handler))
+	if cfg.Tracing != nil {
+		tracer, err := newTracer(*cfg.Tracing)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring tracing: %v", err)
+		}
+		handler = tracer.wrap(handler)
+	}
+	ids, err := newRequestIDs(cfg.RequestID, trusted)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring request IDs: %v", err)
+	}
+	handler = ids.wrap(handler)
+	return withRequestInfo(withClientIP(trusted, handler)), nil
+}
+
+var reloaders struct {
+	mu    sync.Mutex
+	funcs []func() error
+}
+
+// onReload registers f to be called when the proxy receives SIGHUP. It is
+// meant for the global parts of the proxy, which live as long as the
+// process; the routes reload their own parts, see router.reload.
+func onReload(f func() error) {
+	reloaders.mu.Lock()
+	defer reloaders.mu.Unlock()
+	reloaders.funcs = append(reloaders.funcs, f)
+}
+
+func reload() {
+	reloaders.mu.Lock()
+	funcs := reloaders.funcs
+	reloaders.mu.Unlock()
+	for _, f := range funcs {
+		if err := f(); err != nil {
+			log.Printf("error reloading: %v", err)
+		}
+	}
+}
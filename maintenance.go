@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+type maintenanceConfig struct {
+	Enabled    bool     `json:"enabled"`
+	Page       string   `json:"page,omitempty"`
+	RetryAfter duration `json:"retry_after,omitempty"`
+}
+
+const defaultMaintenancePage = "The service is down for maintenance, please retry later.\n"
+
+// newMaintenancePage returns the handler answering all the requests of a
+// route in maintenance with 503 and Retry-After.
+func newMaintenancePage(cfg maintenanceConfig) (http.Handler, error) {
+	page, contentType := []byte(defaultMaintenancePage), "text/plain; charset=utf-8"
+	if cfg.Page != "" {
+		data, err := os.ReadFile(cfg.Page)
+		if err != nil {
+			return nil, err
+		}
+		page, contentType = data, http.DetectContentType(data)
+	}
+	retryAfter := time.Duration(cfg.RetryAfter)
+	if retryAfter == 0 {
+		retryAfter = 5 * time.Minute
+	}
+	seconds := strconv.Itoa(int(retryAfter.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Retry-After", seconds)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(page)
+	}), nil
+}
+
+// setMaintenance switches maintenance on or off for the routes which have
+// a maintenance section, for SIGUSR1 and SIGUSR2.
+func (rt *router) setMaintenance(on bool) error {
+	_, err := rt.update(0, func(configs []routeConfig) ([]routeConfig, error) {
+		for i, rc := range configs {
+			if rc.Maintenance != nil {
+				m := *rc.Maintenance
+				m.Enabled = on
+				configs[i].Maintenance = &m
+			}
+		}
+		return configs, nil
+	})
+	return err
+}
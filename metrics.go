@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics are written in the Prometheus text exposition format by a
+// few small collectors, instead of pulling in the Prometheus client. All
+// label values come from the config (routes and upstreams) or from small
+// fixed sets (status classes and methods), so the cardinality is bounded.
+
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu      sync.Mutex
+	values  map[string]*float64
+	buckets []float64
+	hists   map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newMetricVec(kind, name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]*float64)}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	m := newMetricVec("histogram", name, help, labels...)
+	m.buckets = buckets
+	m.hists = make(map[string]*histogram)
+	return m
+}
+
+func (m *metricVec) add(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+	m.mu.Lock()
+	p, ok := m.values[key]
+	if !ok {
+		p = new(float64)
+		m.values[key] = p
+	}
+	*p += v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) set(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+	m.mu.Lock()
+	m.values[key] = &v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) value(labels ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.values[strings.Join(labels, "\xff")]; ok {
+		return *p
+	}
+	return 0
+}
+
+func (m *metricVec) sum() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total float64
+	for _, p := range m.values {
+		total += *p
+	}
+	return total
+}
+
+func (m *metricVec) observe(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+	m.mu.Lock()
+	h, ok := m.hists[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.hists[key] = h
+	}
+	for i, b := range m.buckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+	m.mu.Unlock()
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.kind != "histogram" {
+		for _, key := range sortedKeys(m.values) {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelString(key, ""), formatFloat(*m.values[key]))
+		}
+		return
+	}
+	for _, key := range sortedKeys(m.hists) {
+		h := m.hists[key]
+		var cumulative uint64
+		for i, b := range m.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(key, formatFloat(b)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(key, "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelString(key, ""), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labelString(key, ""), h.count)
+	}
+}
+
+func (m *metricVec) labelString(key, le string) string {
+	var pairs []string
+	if len(m.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, m.labels[i]+`="`+labelEscaper.Replace(v)+`"`)
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var proxyMetrics = struct {
+	requests          *metricVec
+	duration          *metricVec
+	inFlight          *metricVec
+	requestBytes      *metricVec
+	responseBytes     *metricVec
+	upstreamLatency   *metricVec
+	upstreamUp        *metricVec
+	upstreamErrors    *metricVec
+	upstreamConns     *metricVec
+	upstreamConnsOpen *metricVec
+	clientConns       *metricVec
+	faults            *metricVec
+	mirrored          *metricVec
+	shadowed          *metricVec
+}{
+	requests:          newMetricVec("counter", "proxy_requests_total", "Requests served, by route, upstream, method and status class.", "route", "upstream", "method", "code"),
+	duration:          newHistogramVec("proxy_request_duration_seconds", "Time to serve a request, by route and upstream.", latencyBuckets, "route", "upstream"),
+	inFlight:          newMetricVec("gauge", "proxy_requests_in_flight", "Requests being served, by route.", "route"),
+	requestBytes:      newMetricVec("counter", "proxy_request_bytes_total", "Request body bytes received, by route and upstream.", "route", "upstream"),
+	responseBytes:     newMetricVec("counter", "proxy_response_bytes_total", "Response body bytes sent, by route and upstream.", "route", "upstream"),
+	upstreamLatency:   newHistogramVec("proxy_upstream_latency_seconds", "Time to receive the upstream response headers.", latencyBuckets, "route", "upstream"),
+	upstreamUp:        newMetricVec("gauge", "proxy_upstream_up", "Whether the last request to the upstream succeeded.", "upstream"),
+	upstreamErrors:    newMetricVec("counter", "proxy_upstream_errors_total", "Requests which failed to get a response from the upstream.", "upstream"),
+	upstreamConns:     newMetricVec("counter", "proxy_upstream_connections_total", "Upstream connections used, by whether they were reused from the pool.", "upstream", "reused"),
+	upstreamConnsOpen: newMetricVec("gauge", "proxy_upstream_connections_open", "Open connections to the upstream.", "upstream"),
+	clientConns:       newMetricVec("gauge", "proxy_client_connections", "Client connections, by state.", "state"),
+	faults:            newMetricVec("counter", "proxy_faults_injected_total", "Faults injected, by route and kind of fault.", "route", "fault"),
+	mirrored:          newMetricVec("counter", "proxy_mirrored_requests_total", "Requests mirrored, by route and mirror status class or error.", "route", "code"),
+	shadowed:          newMetricVec("counter", "proxy_shadow_comparisons_total", "Shadow responses compared with the primary ones, by route and result: match, diff or error.", "route", "result"),
+}
+
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := infoOf(r)
+		sw := &statusWriter{ResponseWriter: w}
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		next.ServeHTTP(sw, r)
+
+		method := r.Method
+		if !knownMethods[method] {
+			method = "OTHER"
+		}
+		code := strconv.Itoa(sw.status()/100) + "xx"
+		proxyMetrics.requests.add(1, info.route, info.upstream, method, code)
+		proxyMetrics.duration.observe(time.Since(info.start).Seconds(), info.route, info.upstream)
+		proxyMetrics.requestBytes.add(float64(body.n), info.route, info.upstream)
+		proxyMetrics.responseBytes.add(float64(sw.bytes), info.route, info.upstream)
+		proxyStatus.requestDone(r, sw.status())
+	})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// traceUpstream adds a client trace counting new and reused upstream
+// connections.
+func traceUpstream(ctx context.Context, upstream string) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			proxyMetrics.upstreamConns.add(1, upstream, strconv.FormatBool(info.Reused))
+		},
+	})
+}
+
+// upstreamTransport is the transport shared by all proxied routes. Its
+// dialer keeps track of the open upstream connections.
+var upstreamTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		proxyMetrics.upstreamConnsOpen.add(1, addr)
+		return &countedConn{Conn: conn, addr: addr}, nil
+	}
+	return t
+}()
+
+type countedConn struct {
+	net.Conn
+	addr string
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { proxyMetrics.upstreamConnsOpen.add(-1, c.addr) })
+	return c.Conn.Close()
+}
+
+func trackConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		proxyMetrics.clientConns.add(1, "open")
+	case http.StateClosed, http.StateHijacked:
+		proxyMetrics.clientConns.add(-1, "open")
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range []*metricVec{
+		proxyMetrics.requests, proxyMetrics.duration, proxyMetrics.inFlight,
+		proxyMetrics.requestBytes, proxyMetrics.responseBytes, proxyMetrics.upstreamLatency,
+		proxyMetrics.upstreamUp, proxyMetrics.upstreamErrors, proxyMetrics.upstreamConns,
+		proxyMetrics.upstreamConnsOpen, proxyMetrics.clientConns, proxyMetrics.faults,
+		proxyMetrics.mirrored, proxyMetrics.shadowed,
+	} {
+		m.write(w)
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	for _, m := range []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"go_goroutines", "gauge", "Number of goroutines.", float64(runtime.NumGoroutine())},
+		{"go_memstats_alloc_bytes", "gauge", "Bytes of allocated heap objects.", float64(stats.Alloc)},
+		{"go_memstats_sys_bytes", "gauge", "Bytes of memory obtained from the OS.", float64(stats.Sys)},
+		{"go_memstats_heap_inuse_bytes", "gauge", "Bytes in in-use heap spans.", float64(stats.HeapInuse)},
+		{"go_memstats_heap_objects", "gauge", "Number of allocated heap objects.", float64(stats.HeapObjects)},
+		{"go_gc_cycles_total", "counter", "Completed GC cycles.", float64(stats.NumGC)},
+		{"go_gc_pause_seconds_total", "counter", "Total GC pause time.", float64(stats.PauseTotalNs) / 1e9},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", m.name, m.help, m.name, m.kind, m.name, formatFloat(m.value))
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type mirrorConfig struct {
+	Upstream    string   `json:"upstream"`
+	Percentage  float64  `json:"percentage,omitempty"`
+	Timeout     duration `json:"timeout,omitempty"`
+	MaxBodySize int64    `json:"max_body_size,omitempty"`
+	LogDiffs    bool     `json:"log_diffs,omitempty"`
+}
+
+// mirror copies a percentage of the requests of a route to a secondary
+// upstream, in the background and with its own timeout, and discards the
+// responses once compare, when set, has been given both of them. The
+// requests with a body over max_body_size or upgrading the connection are
+// not mirrored.
+type mirror struct {
+	route    string
+	rc       routeConfig
+	cfg      mirrorConfig
+	upstream *url.URL
+	client   *http.Client
+	compare  func(r *http.Request, primary, mirrored mirrorResult)
+}
+
+// mirrorResult is the part of a response compared with the other one.
+type mirrorResult struct {
+	status  int
+	header  http.Header
+	body    []byte
+	err     error
+	aborted bool
+}
+
+func newMirror(rc routeConfig, cfg mirrorConfig) (*mirror, error) {
+	u, err := url.Parse(cfg.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream %q", cfg.Upstream)
+	}
+	if cfg.Percentage < 0 || cfg.Percentage > 100 {
+		return nil, fmt.Errorf("invalid mirror percentage %v", cfg.Percentage)
+	}
+	if cfg.Percentage == 0 {
+		cfg.Percentage = 100
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = duration(5 * time.Second)
+	}
+	if cfg.MaxBodySize == 0 {
+		cfg.MaxBodySize = 1 << 20
+	}
+	m := &mirror{
+		route:    rc.Name,
+		rc:       rc,
+		cfg:      cfg,
+		upstream: u,
+		client: &http.Client{
+			Transport:     upstreamTransport,
+			Timeout:       time.Duration(cfg.Timeout),
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+	if cfg.LogDiffs {
+		m.compare = m.logDiff
+	}
+	return m, nil
+}
+
+func (m *mirror) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64()*100 >= m.cfg.Percentage || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var body []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, m.cfg.MaxBodySize+1))
+			if err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) > m.cfg.MaxBodySize {
+				r.Body = prependBody(r.Body, body)
+				next.ServeHTTP(w, r)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		out := m.request(r, body)
+		var primary chan mirrorResult
+		if m.compare != nil {
+			primary = make(chan mirrorResult, 1)
+		}
+		go m.send(r, out, primary)
+
+		if primary == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &captureWriter{statusWriter: statusWriter{ResponseWriter: w}, limit: int(m.cfg.MaxBodySize)}
+		served := false
+		// The result is sent even when the handler panics, for example when
+		// the client goes away, since the mirror goroutine waits for it.
+		defer func() {
+			result := mirrorResult{status: cw.status(), header: cw.Header().Clone(), body: cw.buf.Bytes()}
+			if e := infoOf(r).upstreamError; e != "" {
+				result.err = fmt.Errorf("%s", e)
+			}
+			result.aborted = !served
+			primary <- result
+		}()
+		next.ServeHTTP(cw, r)
+		served = true
+	})
+}
+
+// request returns the copy of the request sent to the mirror, which is
+// detached from the client request so that it can outlive it.
+func (m *mirror) request(r *http.Request, body []byte) *http.Request {
+	out := r.Clone(context.Background())
+	out.RequestURI = ""
+	out.Body = http.NoBody
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	out.ContentLength = int64(len(body))
+	for _, h := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"} {
+		out.Header.Del(h)
+	}
+	pr := &httputil.ProxyRequest{In: r, Out: out}
+	pr.SetURL(m.upstream)
+	pr.SetXForwarded()
+	if m.rc.StripPrefix {
+		out.URL.Path = stripPrefix(r.URL.Path, m.rc.Prefix)
+		out.URL.RawPath = ""
+	}
+	if m.compare != nil {
+		// The transport then asks for gzip itself and decompresses it, so
+		// the body can be compared.
+		out.Header.Del("Accept-Encoding")
+	}
+	out.Header.Set("X-Proxy-Mirror", "true")
+	return out
+}
+
+func (m *mirror) send(r, out *http.Request, primary chan mirrorResult) {
+	var result mirrorResult
+	resp, err := m.client.Do(out)
+	if err != nil {
+		result.err = err
+		proxyMetrics.mirrored.add(1, m.route, "error")
+	} else {
+		if primary != nil {
+			result.body, result.err = io.ReadAll(io.LimitReader(resp.Body, m.cfg.MaxBodySize))
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		result.status = resp.StatusCode
+		result.header = resp.Header
+		proxyMetrics.mirrored.add(1, m.route, strconv.Itoa(resp.StatusCode/100)+"xx")
+	}
+	if primary == nil {
+		if err != nil {
+			log.Printf("mirror error on route %s, request %s: %v", m.route, requestID(r), err)
+		}
+		return
+	}
+	// A response cut short by the client is not worth comparing.
+	if p := <-primary; !p.aborted {
+		m.compare(r, p, result)
+	}
+}
+
+func (m *mirror) logDiff(r *http.Request, primary, mirrored mirrorResult) {
+	var err error
+	if primary.body, err = decodeBody(primary.header, primary.body); err != nil {
+		log.Printf("mirror response not compared on route %s, request %s: %v", m.route, requestID(r), err)
+		return
+	}
+	if diff := primary.diff(mirrored); diff != "" {
+		log.Printf("mirror diff on route %s, request %s: %s", m.route, requestID(r), diff)
+	}
+}
+
+// decodeBody returns the body of the primary response decompressed, since
+// the client may have asked for compression. It fails for the encodings
+// other than gzip, and for bodies cut at max_body_size.
+func decodeBody(header http.Header, body []byte) ([]byte, error) {
+	switch enc := header.Get("Content-Encoding"); enc {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(zr)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", enc)
+	}
+}
+
+// diff describes how the mirror response differs from the primary one.
+func (p mirrorResult) diff(m mirrorResult) string {
+	switch {
+	case p.err != nil && m.err != nil:
+		return ""
+	case p.err != nil || m.err != nil:
+		return fmt.Sprintf("error %v != %v", p.err, m.err)
+	case p.status != m.status:
+		return fmt.Sprintf("status %d != %d", p.status, m.status)
+	case !bytes.Equal(p.body, m.body):
+		return fmt.Sprintf("body of %d bytes != %d bytes", len(p.body), len(m.body))
+	}
+	return ""
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type mockConfig struct {
+	Mode         string   `json:"mode"`
+	Dir          string   `json:"dir"`
+	MatchHeaders []string `json:"match_headers,omitempty"`
+	MatchBody    bool     `json:"match_body,omitempty"`
+	IgnoreQuery  []string `json:"ignore_query,omitempty"`
+}
+
+// mockRecording is the file written for every distinct request, which can
+// be edited by hand.
+type mockRecording struct {
+	Request struct {
+		Method  string            `json:"method"`
+		Path    string            `json:"path"`
+		Query   string            `json:"query,omitempty"`
+		Headers map[string]string `json:"headers,omitempty"`
+	} `json:"request"`
+	Response struct {
+		Status       int                 `json:"status"`
+		Headers      map[string][]string `json:"headers"`
+		Body         string              `json:"body"`
+		BodyEncoding string              `json:"body_encoding,omitempty"`
+	} `json:"response"`
+}
+
+const maxMockBody = 10 << 20
+
+// mock records the responses of a route to disk, or serves them from there
+// instead of the upstream. The recordings are matched on the method, the
+// path, the query without the ignored parameters, and optionally some
+// request headers and the request body.
+type mock struct {
+	cfg         mockConfig
+	record      bool
+	replay      bool
+	ignoreQuery map[string]bool
+}
+
+func newMock(cfg mockConfig) (*mock, error) {
+	m := &mock{cfg: cfg, ignoreQuery: nameSet(cfg.IgnoreQuery, func(s string) string { return s })}
+	switch cfg.Mode {
+	case "record":
+		m.record = true
+	case "replay":
+		m.replay = true
+	case "replay_or_record":
+		m.record, m.replay = true, true
+	default:
+		return nil, fmt.Errorf("unknown mock mode %q", cfg.Mode)
+	}
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("mock without a dir")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *mock) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if m.cfg.MatchBody && r.Body != nil {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, maxMockBody+1))
+			if err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			if len(body) > maxMockBody {
+				// The body is too large to be matched, so the request
+				// goes to the upstream, neither replayed nor recorded.
+				r.Body = prependBody(r.Body, body)
+				next.ServeHTTP(w, r)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		rec := m.request(r)
+		file := filepath.Join(m.cfg.Dir, m.key(rec, body)+".json")
+
+		if m.replay {
+			served, err := m.serve(w, file)
+			if err != nil {
+				log.Printf("error replaying %s: %v", file, err)
+			}
+			if served {
+				return
+			}
+			if !m.record {
+				w.Header().Set("X-Proxy-Mock", "miss")
+				http.Error(w, fmt.Sprintf("No recording for %s %s", r.Method, r.URL.RequestURI()), http.StatusBadGateway)
+				return
+			}
+		}
+
+		// The header map is shared with the outer middlewares, so only the
+		// headers added from here on come from the upstream.
+		outer := w.Header().Clone()
+		cw := &captureWriter{statusWriter: statusWriter{ResponseWriter: w}, limit: maxMockBody}
+		next.ServeHTTP(cw, r)
+		if infoOf(r).upstreamError != "" || cw.bytes > int64(cw.buf.Len()) {
+			return
+		}
+		rec.Response.Status = cw.status()
+		rec.Response.Headers = recordedHeaders(outer, cw.Header())
+		if utf8.Valid(cw.buf.Bytes()) {
+			rec.Response.Body = cw.buf.String()
+		} else {
+			rec.Response.Body = base64.StdEncoding.EncodeToString(cw.buf.Bytes())
+			rec.Response.BodyEncoding = "base64"
+		}
+		if err := writeRecording(file, rec); err != nil {
+			log.Printf("error recording %s: %v", file, err)
+		}
+	})
+}
+
+// unrecordedHeaders belong to a single client or response, and must not be
+// replayed to others: cookies, CORS grants and security headers with
+// their nonces. The Access-Control-* headers are skipped by prefix.
+var unrecordedHeaders = map[string]bool{
+	"Date":                                true,
+	"Content-Length":                      true,
+	"X-Request-Id":                        true,
+	"Set-Cookie":                          true,
+	"Vary":                                true,
+	"Content-Security-Policy":             true,
+	"Content-Security-Policy-Report-Only": true,
+	"Strict-Transport-Security":           true,
+	"X-Content-Type-Options":              true,
+	"Referrer-Policy":                     true,
+	"Permissions-Policy":                  true,
+	"X-Frame-Options":                     true,
+}
+
+// recordedHeaders returns the response headers without the values which
+// were already set before the request went to the upstream, and without
+// the unrecordedHeaders.
+func recordedHeaders(outer, header http.Header) map[string][]string {
+	headers := make(map[string][]string)
+	for name, values := range header {
+		if unrecordedHeaders[name] || strings.HasPrefix(name, "Access-Control-") {
+			continue
+		}
+		if prev := outer[name]; len(prev) <= len(values) {
+			same := true
+			for i := range prev {
+				same = same && prev[i] == values[i]
+			}
+			if same {
+				values = values[len(prev):]
+			}
+		}
+		if len(values) > 0 {
+			headers[name] = values
+		}
+	}
+	return headers
+}
+
+// request describes the matched parts of the request.
+func (m *mock) request(r *http.Request) *mockRecording {
+	rec := &mockRecording{}
+	rec.Request.Method = r.Method
+	rec.Request.Path = r.URL.Path
+	query := r.URL.Query()
+	for name := range query {
+		if m.ignoreQuery[name] {
+			query.Del(name)
+		}
+	}
+	rec.Request.Query = query.Encode()
+	for _, name := range m.cfg.MatchHeaders {
+		if v := r.Header.Values(name); len(v) > 0 {
+			if rec.Request.Headers == nil {
+				rec.Request.Headers = make(map[string]string)
+			}
+			rec.Request.Headers[http.CanonicalHeaderKey(name)] = strings.Join(v, ", ")
+		}
+	}
+	return rec
+}
+
+// key names the recording of a request after a hash of its matched parts.
+func (m *mock) key(rec *mockRecording, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", rec.Request.Method, rec.Request.Path, rec.Request.Query)
+	for _, name := range sortedKeys(rec.Request.Headers) {
+		fmt.Fprintf(h, "%s: %s\n", name, rec.Request.Headers[name])
+	}
+	if m.cfg.MatchBody {
+		h.Write(body)
+	}
+	sum := h.Sum(nil)
+	return strings.ToLower(rec.Request.Method) + "-" + hex.EncodeToString(sum[:12])
+}
+
+func (m *mock) serve(w http.ResponseWriter, file string) (bool, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var rec mockRecording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return false, err
+	}
+	body := []byte(rec.Response.Body)
+	if rec.Response.BodyEncoding == "base64" {
+		if body, err = base64.StdEncoding.DecodeString(rec.Response.Body); err != nil {
+			return false, err
+		}
+	}
+	for name, values := range rec.Response.Headers {
+		w.Header()[http.CanonicalHeaderKey(name)] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("X-Proxy-Mock", "replay")
+	if rec.Response.Status == 0 {
+		rec.Response.Status = http.StatusOK
+	}
+	w.WriteHeader(rec.Response.Status)
+	w.Write(body)
+	return true, nil
+}
+
+func writeRecording(file string, rec *mockRecording) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rec); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".recording-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestMockRecordingBehindCORSAndOIDC records a response on a route where
+// the OIDC login refreshes the session cookie and CORS grants the origin,
+// and checks that neither is replayed to other clients.
+func TestMockRecordingBehindCORSAndOIDC(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			io.WriteString(w, `{"authorization_endpoint":"http://`+r.Host+`/authorize","token_endpoint":"http://`+r.Host+`/token","jwks_uri":"http://`+r.Host+`/jwks"}`)
+		case "/token":
+			io.WriteString(w, `{"access_token":"a2","refresh_token":"r2","expires_in":300}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer idp.Close()
+
+	login, err := newOIDCLogin(oidcConfig{Issuer: idp.URL, ClientID: "proxy", RedirectURL: "http://proxy.example/oauth2/callback", CookieSecret: "cookie-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw := httptest.NewRecorder()
+	now := time.Now().Unix()
+	login.setCookie(cw, "proxy_session", &oidcSession{Claims: jwtClaims{"sub": "alice"}, Expiry: now - 1, Issued: now, Refresh: "r1"}, time.Hour)
+	cookie := cw.Result().Cookies()[0]
+
+	c, err := newCORS(corsConfig{AllowedOrigins: []string{"https://app.example"}, AllowCredentials: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	recorder, err := newMock(mockConfig{Mode: "record", Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := newSecurityHeaders(securityHeadersConfig{ContentSecurityPolicy: "script-src 'nonce-{nonce}'"})
+	upstream := headers.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Upstream", "yes")
+		io.WriteString(w, `{"items":[]}`)
+	}))
+
+	r := httptest.NewRequest("GET", "/api/items", nil)
+	r.Header.Set("Origin", "https://app.example")
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	c.wrap(login.wrap(recorder.wrap(upstream))).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Set-Cookie") == "" || w.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Fatalf("recording: status %d, headers %v, want 200 with a cookie and a CORS grant", w.Code, w.Header())
+	}
+
+	replayer, err := newMock(mockConfig{Mode: "replay", Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	replayer.wrap(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/api/items", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"items":[]}` {
+		t.Fatalf("replay: status %d, body %q", w.Code, w.Body)
+	}
+	for _, name := range []string{"Content-Type", "X-Upstream", "X-Proxy-Mock"} {
+		if w.Header().Get(name) == "" {
+			t.Errorf("replay: %s missing", name)
+		}
+	}
+	for _, name := range []string{"Set-Cookie", "Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Vary", "Content-Security-Policy"} {
+		if v := w.Header().Get(name); v != "" {
+			t.Errorf("replay: %s: %s recorded", name, v)
+		}
+	}
+}
+
+func TestRecordedHeaders(t *testing.T) {
+	outer := http.Header{"Vary": {"Origin"}, "X-Outer": {"a"}, "Cache-Control": {"no-store"}}
+	header := http.Header{
+		"Vary":          {"Origin", "Accept"},
+		"X-Outer":       {"a"},
+		"Cache-Control": {"max-age=60"},
+		"X-Upstream":    {"b", "c"},
+		"Set-Cookie":    {"id=1"},
+		"Date":          {"Thu, 15 Oct 2026 12:00:00 GMT"},
+	}
+	got := recordedHeaders(outer, header)
+	want := map[string][]string{"Cache-Control": {"max-age=60"}, "X-Upstream": {"b", "c"}}
+	if len(got) != len(want) {
+		t.Fatalf("recorded %v, want %v", got, want)
+	}
+	for name, values := range want {
+		if len(got[name]) != len(values) || got[name][0] != values[0] {
+			t.Errorf("%s: recorded %v, want %v", name, got[name], values)
+		}
+	}
+}
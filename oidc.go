@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type oidcConfig struct {
+	Issuer                string            `json:"issuer"`
+	ClientID              string            `json:"client_id"`
+	ClientSecret          string            `json:"client_secret"`
+	RedirectURL           string            `json:"redirect_url"`
+	LogoutPath            string            `json:"logout_path"`
+	PostLogoutRedirectURL string            `json:"post_logout_redirect_url"`
+	Scopes                []string          `json:"scopes"`
+	CookieName            string            `json:"cookie_name"`
+	CookieSecret          string            `json:"cookie_secret"`
+	SessionTTL            duration          `json:"session_ttl"`
+	ForwardClaims         map[string]string `json:"forward_claims"`
+	ForwardAccessToken    bool              `json:"forward_access_token"`
+}
+
+// oidcLogin makes the proxy an OpenID Connect relying party using the
+// authorization code flow with PKCE. The session is kept in a cookie
+// encrypted with AES-GCM, so the proxy itself stays stateless.
+type oidcLogin struct {
+	cfg      oidcConfig
+	aead     cipher.AEAD
+	callback *url.URL
+	secure   bool
+
+	mu        sync.Mutex
+	provider  *oidcProvider
+	discovery chan struct{}
+	failed    time.Time
+	failure   error
+}
+
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+
+	verifier *jwtVerifier
+}
+
+type oidcSession struct {
+	Claims  jwtClaims `json:"c"`
+	Expiry  int64     `json:"e"`
+	Issued  int64     `json:"i"`
+	Refresh string    `json:"r,omitempty"`
+	Access  string    `json:"a,omitempty"`
+}
+
+type oidcState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	URL      string `json:"u"`
+	Issued   int64  `json:"i"`
+}
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcRetryDelay is how long a failed discovery is remembered before the
+// provider is asked again.
+const oidcRetryDelay = 10 * time.Second
+
+func newOIDCLogin(cfg oidcConfig) (*oidcLogin, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("issuer, client_id and redirect_url are required")
+	}
+	if cfg.CookieSecret == "" {
+		return nil, errors.New("cookie_secret is required")
+	}
+	callback, err := url.Parse(cfg.RedirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing redirect URL: %v", err)
+	}
+	if cfg.CookieName == "" {
+		cfg.CookieName = "proxy_session"
+	}
+	if cfg.LogoutPath == "" {
+		cfg.LogoutPath = "/oauth2/logout"
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	if cfg.SessionTTL == 0 {
+		cfg.SessionTTL = duration(24 * time.Hour)
+	}
+
+	key := sha256.Sum256([]byte(cfg.CookieSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &oidcLogin{cfg: cfg, aead: aead, callback: callback, secure: callback.Scheme == "https"}, nil
+}
+
+func (o *oidcLogin) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case o.callback.Path:
+			o.handleCallback(w, r)
+			return
+		case o.cfg.LogoutPath:
+			o.handleLogout(w, r)
+			return
+		}
+
+		for _, header := range o.cfg.ForwardClaims {
+			r.Header.Del(header)
+		}
+
+		var session oidcSession
+		if err := o.readCookie(r, o.cfg.CookieName, &session); err != nil {
+			o.login(w, r)
+			return
+		}
+		if time.Now().Unix() >= session.Expiry {
+			if err := o.refresh(&session); err != nil {
+				o.login(w, r)
+				return
+			}
+			o.setCookie(w, o.cfg.CookieName, &session, time.Duration(o.cfg.SessionTTL))
+		}
+
+		removeCookie(r, o.cfg.CookieName)
+		for claim, header := range o.cfg.ForwardClaims {
+			if values := session.Claims.values(claim); len(values) > 0 {
+				r.Header.Set(header, strings.Join(values, " "))
+			}
+		}
+		if o.cfg.ForwardAccessToken && session.Access != "" {
+			r.Header.Set("Authorization", "Bearer "+session.Access)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// login redirects browsers to the identity provider. Requests which are
+// not plain navigations are rejected instead.
+func (o *oidcLogin) login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	provider, err := o.discover()
+	if err != nil {
+		log.Printf("error discovering OIDC provider %s for request %s: %v", o.cfg.Issuer, requestID(r), err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	state := oidcState{
+		State:    randomString(16),
+		Nonce:    randomString(16),
+		Verifier: randomString(32),
+		URL:      localURL(r.URL.RequestURI()),
+		Issued:   time.Now().Unix(),
+	}
+	o.setCookie(w, o.cfg.CookieName+"_login", &state, 10*time.Minute)
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.cfg.ClientID},
+		"redirect_uri":          {o.cfg.RedirectURL},
+		"scope":                 {strings.Join(o.cfg.Scopes, " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, withQuery(provider.AuthorizationEndpoint, q), http.StatusFound)
+}
+
+func (o *oidcLogin) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var state oidcState
+	err := o.readCookie(r, o.cfg.CookieName+"_login", &state)
+	o.clearCookie(w, o.cfg.CookieName+"_login")
+	if err != nil || time.Since(time.Unix(state.Issued, 0)) > 10*time.Minute {
+		http.Error(w, "Login session expired", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, fmt.Sprintf("Login failed: %s", e), http.StatusUnauthorized)
+		return
+	}
+	if q.Get("state") != state.State {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	session, err := o.exchange(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {q.Get("code")},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"code_verifier": {state.Verifier},
+	}, state.Nonce)
+	if err != nil {
+		log.Printf("error completing OIDC login for request %s: %v", requestID(r), err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	o.setCookie(w, o.cfg.CookieName, session, time.Duration(o.cfg.SessionTTL))
+	http.Redirect(w, r, localURL(state.URL), http.StatusFound)
+}
+
+// localURL returns the URL to go back to after the login, made a path on
+// this host, so that a request like //evil.example/ does not redirect
+// elsewhere.
+func localURL(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "" || u.Host != "" || strings.Contains(u.Path, "\\") {
+		return "/"
+	}
+	p := path.Clean("/" + u.EscapedPath())
+	if strings.HasSuffix(u.EscapedPath(), "/") && p != "/" {
+		p += "/"
+	}
+	if u.RawQuery != "" {
+		p += "?" + u.RawQuery
+	}
+	return p
+}
+
+func (o *oidcLogin) handleLogout(w http.ResponseWriter, r *http.Request) {
+	o.clearCookie(w, o.cfg.CookieName)
+	target := o.cfg.PostLogoutRedirectURL
+	if target == "" {
+		target = "/"
+	}
+	if provider, err := o.discover(); err == nil && provider.EndSessionEndpoint != "" {
+		q := url.Values{"client_id": {o.cfg.ClientID}}
+		if o.cfg.PostLogoutRedirectURL != "" {
+			q.Set("post_logout_redirect_uri", o.cfg.PostLogoutRedirectURL)
+		}
+		target = withQuery(provider.EndSessionEndpoint, q)
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func (o *oidcLogin) refresh(session *oidcSession) error {
+	if session.Refresh == "" {
+		return errors.New("no refresh token")
+	}
+	if time.Since(time.Unix(session.Issued, 0)) > time.Duration(o.cfg.SessionTTL) {
+		return errors.New("session is too old")
+	}
+	refreshed, err := o.exchange(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {session.Refresh},
+	}, "")
+	if err != nil {
+		return err
+	}
+	if refreshed.Claims == nil {
+		refreshed.Claims = session.Claims
+	}
+	if refreshed.Refresh == "" {
+		refreshed.Refresh = session.Refresh
+	}
+	refreshed.Issued = session.Issued
+	*session = *refreshed
+	return nil
+}
+
+// exchange calls the token endpoint and builds a session from the
+// response. The ID token is required unless refreshing.
+func (o *oidcLogin) exchange(form url.Values, nonce string) (*oidcSession, error) {
+	provider, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	var tokens struct {
+		AccessToken  string `json:"access_token"`
+		IDToken      string `json:"id_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	session := &oidcSession{Issued: now, Refresh: tokens.RefreshToken, Expiry: now + 300}
+	if o.cfg.ForwardAccessToken {
+		session.Access = tokens.AccessToken
+	}
+	if tokens.IDToken == "" {
+		if form.Get("grant_type") != "refresh_token" {
+			return nil, errors.New("no ID token in response")
+		}
+	} else {
+		claims, err := provider.verifier.verify(tokens.IDToken)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID token: %v", err)
+		}
+		if nonce != "" && claims["nonce"] != nonce {
+			return nil, errors.New("invalid ID token nonce")
+		}
+		// Only the forwarded claims are kept to keep the cookie small.
+		session.Claims = jwtClaims{"sub": claims["sub"]}
+		for claim := range o.cfg.ForwardClaims {
+			if v, ok := claims[claim]; ok {
+				session.Claims[claim] = v
+			}
+		}
+		if exp, ok := claims["exp"].(float64); ok {
+			session.Expiry = int64(exp)
+		}
+	}
+	if tokens.ExpiresIn > 0 {
+		session.Expiry = now + tokens.ExpiresIn
+	}
+	return session, nil
+}
+
+// discover fetches the provider metadata on first use, so that the proxy
+// can start before the identity provider does. Only one request fetches
+// it, without holding the lock, and the others wait for its result. A
+// failure is returned to everyone for oidcRetryDelay, so that the requests
+// do not pile up while the provider is down.
+func (o *oidcLogin) discover() (*oidcProvider, error) {
+	o.mu.Lock()
+	for o.provider == nil && o.discovery != nil {
+		done := o.discovery
+		o.mu.Unlock()
+		<-done
+		o.mu.Lock()
+	}
+	if provider := o.provider; provider != nil {
+		o.mu.Unlock()
+		return provider, nil
+	}
+	if err := o.failure; err != nil && time.Since(o.failed) < oidcRetryDelay {
+		o.mu.Unlock()
+		return nil, err
+	}
+	done := make(chan struct{})
+	o.discovery = done
+	o.mu.Unlock()
+
+	provider, err := o.fetchProvider()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.discovery = nil
+	close(done)
+	if err != nil {
+		o.failed, o.failure = time.Now(), err
+		return nil, err
+	}
+	o.provider = provider
+	return provider, nil
+}
+
+func (o *oidcLogin) fetchProvider() (*oidcProvider, error) {
+	resp, err := oidcClient.Get(strings.TrimSuffix(o.cfg.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned %s", resp.Status)
+	}
+	provider := &oidcProvider{}
+	if err := json.NewDecoder(resp.Body).Decode(provider); err != nil {
+		return nil, err
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("incomplete provider metadata")
+	}
+	provider.verifier = &jwtVerifier{
+		keys:       &keySet{url: provider.JWKSURI, refresh: time.Hour},
+		issuer:     o.cfg.Issuer,
+		audience:   []string{o.cfg.ClientID},
+		leeway:     time.Minute,
+		requireExp: true,
+	}
+	return provider, nil
+}
+
+func (o *oidcLogin) setCookie(w http.ResponseWriter, name string, v any, ttl time.Duration) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error encoding cookie %s: %v", name, err)
+		return
+	}
+	nonce := make([]byte, o.aead.NonceSize())
+	rand.Read(nonce)
+	sealed := o.aead.Seal(nonce, nonce, data, []byte(name))
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    base64.RawURLEncoding.EncodeToString(sealed),
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   o.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (o *oidcLogin) readCookie(r *http.Request, name string, v any) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(sealed) < o.aead.NonceSize() {
+		return errors.New("malformed cookie")
+	}
+	size := o.aead.NonceSize()
+	data, err := o.aead.Open(nil, sealed[:size], sealed[size:], []byte(name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (o *oidcLogin) clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1, Secure: o.secure, HttpOnly: true})
+}
+
+// removeCookie drops a cookie from the request before it goes upstream.
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func withQuery(endpoint string, q url.Values) string {
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + q.Encode()
+	}
+	return endpoint + "?" + q.Encode()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOIDCDiscovery(t *testing.T) {
+	var hits atomic.Int32
+	var up atomic.Bool
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		if !up.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"authorization_endpoint":"http://idp/authorize","token_endpoint":"http://idp/token","jwks_uri":"http://idp/jwks"}`)
+	}))
+	defer idp.Close()
+	o, err := newOIDCLogin(oidcConfig{Issuer: idp.URL, ClientID: "proxy", RedirectURL: "http://proxy.example/oauth2/callback", CookieSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var failures atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := o.discover(); err != nil {
+				failures.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if hits.Load() != 1 || failures.Load() != 10 {
+		t.Fatalf("provider down: %d fetches and %d failures, want 1 and 10", hits.Load(), failures.Load())
+	}
+
+	up.Store(true)
+	if _, err := o.discover(); err == nil || hits.Load() != 1 {
+		t.Fatalf("failure not remembered: err %v, %d fetches", err, hits.Load())
+	}
+	o.mu.Lock()
+	o.failed = time.Now().Add(-oidcRetryDelay)
+	o.mu.Unlock()
+	provider, err := o.discover()
+	if err != nil || provider.TokenEndpoint != "http://idp/token" {
+		t.Fatalf("discovery after the retry delay: %v", err)
+	}
+	if _, err := o.discover(); err != nil || hits.Load() != 2 {
+		t.Fatalf("provider not kept: err %v, %d fetches", err, hits.Load())
+	}
+}
+
+func TestLocalURL(t *testing.T) {
+	for uri, want := range map[string]string{
+		"/app/page?x=1":         "/app/page?x=1",
+		"/app/":                 "/app/",
+		"/a/../b":               "/b",
+		"//evil.example/":       "/",
+		"https://evil.example/": "/",
+		"/\\evil.example":       "/",
+		"/%2F%2Fevil.example":   "/%2F%2Fevil.example",
+		"relative/path":         "/relative/path",
+		"/../../etc/passwd?q=1": "/etc/passwd?q=1",
+		"javascript:alert(1)":   "/",
+		"///evil.example/x":     "/evil.example/x",
+	} {
+		if got := localURL(uri); got != want {
+			t.Errorf("localURL(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// requestInfo collects what the proxy learns about a request while serving
+// it, for the access log and the other observers of finished requests.
+type requestInfo struct {
+	start           time.Time
+	requestID       string
+	route           string
+	upstream        string
+	upstreamLatency time.Duration
+	upstreamError   string
+}
+
+func withRequestInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &requestInfo{start: time.Now()}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)))
+	})
+}
+
+// infoOf returns the info of the request, or a throwaway one for requests
+// which did not come through the proxy handler.
+func infoOf(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{start: time.Now()}
+}
+
+// timedTransport records which upstream served the request and how long
+// it took to get the response headers.
+type timedTransport struct {
+	http.RoundTripper
+}
+
+func (t timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	info := infoOf(req)
+	info.upstream = req.URL.Host
+	req = req.WithContext(traceUpstream(req.Context(), info.upstream))
+	req, span := traceUpstreamSpan(req)
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	info.upstreamLatency = time.Since(start)
+	if span != nil {
+		if err != nil {
+			span.err = err.Error()
+		} else {
+			span.set("http.response.status_code", resp.StatusCode)
+		}
+		span.finish()
+	}
+
+	if err != nil && req.Context().Err() == nil {
+		proxyMetrics.upstreamErrors.add(1, info.upstream)
+		proxyMetrics.upstreamUp.set(0, info.upstream)
+		proxyStatus.upstreamDone(info.upstream, err)
+	} else if err == nil {
+		proxyMetrics.upstreamUp.set(1, info.upstream)
+		proxyMetrics.upstreamLatency.observe(info.upstreamLatency.Seconds(), info.route, info.upstream)
+		proxyStatus.upstreamDone(info.upstream, nil)
+	}
+	return resp, err
+}
+
+// prependBody returns a body reading b and then the rest of rc, for a body
+// which has been partly read to be inspected.
+func prependBody(rc io.ReadCloser, b []byte) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), rc), rc}
+}
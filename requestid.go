@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+type requestIDConfig struct {
+	Header        string `json:"header"`
+	Format        string `json:"format"`
+	TrustIncoming string `json:"trust_incoming"`
+}
+
+// requestIDs gives every request an ID, which is passed to the upstream in
+// the request header, returned to the client in the same response header,
+// and included in the logs and error pages. An incoming ID is kept when it
+// comes from a trusted proxy, or from anyone with "trust_incoming": "always".
+type requestIDs struct {
+	header   string
+	generate func() string
+	trusted  func(r *http.Request) bool
+}
+
+func newRequestIDs(cfg requestIDConfig, trusted []netip.Prefix) (*requestIDs, error) {
+	ids := &requestIDs{header: http.CanonicalHeaderKey(cfg.Header)}
+	if ids.header == "" {
+		ids.header = "X-Request-Id"
+	}
+	switch cfg.Format {
+	case "", "uuidv7":
+		ids.generate = uuidv7
+	case "ulid":
+		ids.generate = ulid
+	default:
+		return nil, fmt.Errorf("unknown request ID format %q", cfg.Format)
+	}
+	switch cfg.TrustIncoming {
+	case "", "trusted_proxies":
+		ids.trusted = func(r *http.Request) bool { return containsAddr(trusted, remoteIP(r)) }
+	case "always":
+		ids.trusted = func(*http.Request) bool { return true }
+	case "never":
+		ids.trusted = func(*http.Request) bool { return false }
+	default:
+		return nil, fmt.Errorf("unknown trust_incoming %q", cfg.TrustIncoming)
+	}
+	return ids, nil
+}
+
+func (ids *requestIDs) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(ids.header)
+		if !ids.trusted(r) || !validRequestID(id) {
+			id = ids.generate()
+		}
+		infoOf(r).requestID = id
+		r.Header.Set(ids.header, id)
+		w.Header().Set(ids.header, id)
+		// The upstream may return its own ID, which is replaced so that the
+		// client sees the one in the logs.
+		hw := &hookWriter{ResponseWriter: w, before: func(int) { w.Header().Set(ids.header, id) }}
+		next.ServeHTTP(hw, r)
+	})
+}
+
+// validRequestID accepts up to 128 printable ASCII characters, so that an
+// incoming ID cannot break the log formats.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '"' || id[i] == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func requestID(r *http.Request) string {
+	return infoOf(r).requestID
+}
+
+// timestampedRandom returns 16 bytes starting with the 48-bit Unix time in
+// milliseconds, followed by random bits.
+func timestampedRandom() [16]byte {
+	var b [16]byte
+	rand.Read(b[6:])
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+	copy(b[:6], ms[2:])
+	return b
+}
+
+func uuidv7() string {
+	b := timestampedRandom()
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+	s := hex.EncodeToString(b[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func ulid() string {
+	b := timestampedRandom()
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var s [26]byte
+	for i := range s {
+		shift := uint(5 * (25 - i))
+		var v uint64
+		switch {
+		case shift >= 64:
+			v = hi >> (shift - 64)
+		case shift > 59:
+			v = lo>>shift | hi<<(64-shift)
+		default:
+			v = lo >> shift
+		}
+		s[i] = crockford[v&31]
+	}
+	return string(s[:])
+}
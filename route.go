@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type route struct {
+	name      string
+	prefix    string
+	handler   http.Handler
+	targets   []*target
+	reloaders []func() error
+}
+
+// routingTable is an immutable version of the routes. Changes build a new
+// table, which replaces the old one atomically, so requests always see a
+// consistent set of routes.
+type routingTable struct {
+	version uint64
+	configs []routeConfig
+	routes  []*route
+}
+
+type router struct {
+	cfg   *config
+	table atomic.Pointer[routingTable]
+	mu    sync.Mutex
+}
+
+var errVersionMismatch = errors.New("routing table version mismatch")
+
+func newRouter(cfg *config) (*router, error) {
+	rt := &router{cfg: cfg}
+	table, err := rt.build(&routingTable{}, cfg.Routes)
+	if err != nil {
+		return nil, err
+	}
+	rt.table.Store(table)
+	return rt, nil
+}
+
+// update applies change to a copy of the route configs and swaps in the
+// resulting table. A non-zero version must match the current one.
+func (rt *router) update(version uint64, change func([]routeConfig) ([]routeConfig, error)) (*routingTable, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	current := rt.table.Load()
+	if version != 0 && version != current.version {
+		return nil, errVersionMismatch
+	}
+	configs, err := change(append([]routeConfig(nil), current.configs...))
+	if err != nil {
+		return nil, err
+	}
+	table, err := rt.build(current, configs)
+	if err != nil {
+		return nil, err
+	}
+	rt.table.Store(table)
+	return table, nil
+}
+
+// build makes the routing table following current, reusing the routes
+// whose config did not change.
+func (rt *router) build(current *routingTable, configs []routeConfig) (*routingTable, error) {
+	previous := make(map[string]int)
+	for i, rc := range current.configs {
+		previous[rc.Name] = i
+	}
+	table := &routingTable{version: current.version + 1, configs: configs}
+	names := make(map[string]bool)
+	for i, rc := range configs {
+		if rc.Name == "" || !strings.HasPrefix(rc.Prefix, "/") {
+			return nil, fmt.Errorf("route %d needs a name and a prefix starting with /", i)
+		}
+		if names[rc.Name] {
+			return nil, fmt.Errorf("duplicate route name %s", rc.Name)
+		}
+		names[rc.Name] = true
+
+		j, ok := previous[rc.Name]
+		if ok && reflect.DeepEqual(current.configs[j], rc) {
+			table.routes = append(table.routes, current.routes[j])
+			continue
+		}
+		r, err := newRoute(rt.cfg, rc)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			adoptCounters(r.targets, current.routes[j].targets)
+		}
+		table.routes = append(table.routes, r)
+	}
+	return table, nil
+}
+
+// reload re-reads the files of the current routes, such as access lists
+// and credentials. The routes replaced since are left alone.
+func (rt *router) reload() {
+	for _, route := range rt.table.Load().routes {
+		for _, f := range route.reloaders {
+			if err := f(); err != nil {
+				log.Printf("error reloading route %s: %v", route.name, err)
+			}
+		}
+	}
+}
+
+func indexOfRoute(configs []routeConfig, name string) int {
+	for i, rc := range configs {
+		if rc.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, route := range rt.table.Load().routes {
+		if strings.HasPrefix(r.URL.Path, route.prefix) {
+			infoOf(r).route = route.name
+			proxyMetrics.inFlight.add(1, route.name)
+			defer proxyMetrics.inFlight.add(-1, route.name)
+			route.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func newRoute(cfg *config, rc routeConfig) (*route, error) {
+	var handler http.Handler
+	var targets []*target
+	var reloaders []func() error
+	switch {
+	case rc.Stub != nil && (rc.Upstream != "" || len(rc.Targets) > 0):
+		return nil, fmt.Errorf("route %s has both a stub and an upstream", rc.Name)
+	case rc.Stub != nil:
+		var err error
+		if handler, err = newStub(*rc.Stub); err != nil {
+			return nil, fmt.Errorf("error loading stub of route %s: %v", rc.Name, err)
+		}
+	case rc.Upstream != "" && len(rc.Targets) > 0:
+		return nil, fmt.Errorf("route %s has both an upstream and targets", rc.Name)
+	case rc.Upstream == "" && len(rc.Targets) == 0:
+		return nil, fmt.Errorf("route %s has no upstream", rc.Name)
+	default:
+		var err error
+		if targets, err = newTargets(rc); err != nil {
+			return nil, fmt.Errorf("error parsing %s URL: %v", rc.Name, err)
+		}
+		handler = newProxy(rc)
+	}
+
+	if rc.SecurityHeaders != nil {
+		headers := newSecurityHeaders(*rc.SecurityHeaders)
+		if proxy, ok := handler.(*httputil.ReverseProxy); ok {
+			addRewrite(proxy, headers.rewrite)
+			addResponseModifier(proxy, headers.modifyResponse)
+		} else {
+			handler = headers.wrap(handler)
+		}
+	}
+	if targets != nil {
+		handler = &balancer{targets: targets, next: handler}
+	}
+	if rc.Mirror != nil {
+		if targets == nil {
+			return nil, fmt.Errorf("route %s has a mirror but no upstream", rc.Name)
+		}
+		mirror, err := newMirror(rc, *rc.Mirror)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring mirror of route %s: %v", rc.Name, err)
+		}
+		handler = mirror.wrap(handler)
+	}
+	if rc.Shadow != nil {
+		if targets == nil {
+			return nil, fmt.Errorf("route %s has a shadow but no upstream", rc.Name)
+		}
+		shadow, err := newShadow(rc)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring shadow of route %s: %v", rc.Name, err)
+		}
+		handler = shadow.wrap(handler)
+	}
+	if rc.Mock != nil {
+		mock, err := newMock(*rc.Mock)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring mock of route %s: %v", rc.Name, err)
+		}
+		handler = mock.wrap(handler)
+	}
+	if len(rc.Faults) > 0 {
+		faults, err := newFaults(rc.Name, rc.Faults)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring faults of route %s: %v", rc.Name, err)
+		}
+		handler = faults.wrap(handler)
+	}
+	if rc.SignedURL != nil {
+		signed, err := newSignedURLs(*rc.SignedURL)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring signed URLs of route %s: %v", rc.Name, err)
+		}
+		handler = signed.wrap(handler)
+	}
+	if rc.ForwardAuth != nil {
+		auth, err := newForwardAuth(*rc.ForwardAuth)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring forward auth of route %s: %v", rc.Name, err)
+		}
+		handler = auth.wrap(handler)
+	}
+	if rc.OIDC != nil {
+		login, err := newOIDCLogin(*rc.OIDC)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring OIDC of route %s: %v", rc.Name, err)
+		}
+		handler = login.wrap(handler)
+	}
+	if rc.JWT != nil {
+		auth, err := newJWTAuth(*rc.JWT)
+		if err != nil {
+			return nil, fmt.Errorf("error loading JWT keys of route %s: %v", rc.Name, err)
+		}
+		reloaders = append(reloaders, auth.verifier.keys.load)
+		handler = auth.wrap(handler)
+	}
+	if rc.Auth != nil {
+		auth, err := newAuthenticator(*rc.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("error loading auth of route %s: %v", rc.Name, err)
+		}
+		reloaders = append(reloaders, auth.load)
+		handler = auth.wrap(handler)
+	}
+	if rc.CORS != nil {
+		cors, err := newCORS(*rc.CORS)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring CORS of route %s: %v", rc.Name, err)
+		}
+		handler = cors.wrap(handler)
+	}
+	if rc.WAF != nil {
+		waf, err := newWAF(rc.Name, *rc.WAF, cfg.WAFRules)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring WAF of route %s: %v", rc.Name, err)
+		}
+		handler = waf.wrap(handler)
+	}
+	if rc.Access != nil {
+		access, err := newAccessList(rc.Access)
+		if err != nil {
+			return nil, fmt.Errorf("error loading access rules of route %s: %v", rc.Name, err)
+		}
+		reloaders = append(reloaders, access.load)
+		handler = access.wrap(handler)
+	}
+	if rc.Capture != nil {
+		har, err := newHARRecorder(rc.Name, *rc.Capture)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring capture of route %s: %v", rc.Name, err)
+		}
+		handler = har.wrap(handler)
+	}
+	if rc.Maintenance != nil && rc.Maintenance.Enabled {
+		page, err := newMaintenancePage(*rc.Maintenance)
+		if err != nil {
+			return nil, fmt.Errorf("error loading maintenance page of route %s: %v", rc.Name, err)
+		}
+		handler = page
+	}
+	return &route{name: rc.Name, prefix: rc.Prefix, handler: handler, targets: targets, reloaders: reloaders}, nil
+}
+
+func newProxy(rc routeConfig) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Transport: timedTransport{upstreamTransport},
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(targetOf(r.In).url)
+			r.SetXForwarded()
+			if rc.StripPrefix {
+				r.Out.URL.Path = stripPrefix(r.In.URL.Path, rc.Prefix)
+				r.Out.URL.RawPath = ""
+			}
+		},
+		ErrorHandler: proxyError,
+	}
+}
+
+func stripPrefix(path, prefix string) string {
+	path = strings.TrimPrefix(path, prefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// addRewrite chains f after the existing Rewrite of the proxy.
+func addRewrite(proxy *httputil.ReverseProxy, f func(*httputil.ProxyRequest)) {
+	previous := proxy.Rewrite
+	proxy.Rewrite = func(r *httputil.ProxyRequest) {
+		previous(r)
+		f(r)
+	}
+}
+
+// addResponseModifier chains f after the existing ModifyResponse of the
+// proxy.
+func addResponseModifier(proxy *httputil.ReverseProxy, f func(*http.Response) error) {
+	previous := proxy.ModifyResponse
+	if previous == nil {
+		proxy.ModifyResponse = f
+		return
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if err := previous(resp); err != nil {
+			return err
+		}
+		return f(resp)
+	}
+}
+
+// proxyError logs a failed upstream request and answers with a 502 page
+// showing the request ID.
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	infoOf(r).upstreamError = err.Error()
+	if r.Context().Err() == nil {
+		log.Printf("proxy error on route %s, request %s: %v", infoOf(r).route, requestID(r), err)
+	}
+	http.Error(w, fmt.Sprintf("Bad Gateway\nRequest ID: %s", requestID(r)), http.StatusBadGateway)
+}
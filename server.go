@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// serverConfig holds the timeouts and limits of the client connections.
+// MaxConnectionsPerIP counts the connections of each TCP peer, not of the
+// client IP resolved from X-Forwarded-For: behind a load balancer the peer
+// is the balancer, and all the clients share one cap.
+type serverConfig struct {
+	ReadHeaderTimeout   duration `json:"read_header_timeout"`
+	ReadTimeout         duration `json:"read_timeout"`
+	WriteTimeout        duration `json:"write_timeout"`
+	IdleTimeout         duration `json:"idle_timeout"`
+	MaxHeaderBytes      int      `json:"max_header_bytes"`
+	MaxConnections      int      `json:"max_connections"`
+	MaxConnectionsPerIP int      `json:"max_connections_per_ip"`
+	MinUploadRate       int64    `json:"min_upload_rate"`
+	UploadGracePeriod   duration `json:"upload_grace_period"`
+}
+
+func newServer(cfg serverConfig, handler http.Handler) *http.Server {
+	if cfg.ReadHeaderTimeout == 0 {
+		cfg.ReadHeaderTimeout = duration(10 * time.Second)
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = duration(2 * time.Minute)
+	}
+	if cfg.MinUploadRate > 0 {
+		handler = withMinUploadRate(cfg.MinUploadRate, time.Duration(cfg.UploadGracePeriod), handler)
+	}
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ConnState:         trackConnState,
+	}
+}
+
+// limitListener caps the number of open connections, globally and per
+// client IP. When the global limit is reached it stops accepting, so that
+// new connections wait in the kernel backlog instead of being served
+// half-way.
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+	perIP int
+
+	mu    sync.Mutex
+	conns map[netip.Addr]int
+}
+
+func newLimitListener(ln net.Listener, max, perIP int) net.Listener {
+	if max <= 0 && perIP <= 0 {
+		return ln
+	}
+	l := &limitListener{Listener: ln, perIP: perIP, conns: make(map[netip.Addr]int)}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if l.slots != nil {
+			l.slots <- struct{}{}
+		}
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.release()
+			return nil, err
+		}
+
+		ip := netip.Addr{}
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.AddrPort().Addr().Unmap()
+		}
+		if l.acquire(ip) {
+			return &limitConn{Conn: conn, listener: l, ip: ip}, nil
+		}
+		conn.Close()
+		l.release()
+	}
+}
+
+func (l *limitListener) acquire(ip netip.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.perIP > 0 && l.conns[ip] >= l.perIP {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *limitListener) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *limitListener) done(ip netip.Addr) {
+	l.mu.Lock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+	l.mu.Unlock()
+	l.release()
+}
+
+type limitConn struct {
+	net.Conn
+	listener *limitListener
+	ip       netip.Addr
+	once     sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.listener.done(c.ip) })
+	return err
+}
+
+var errSlowUpload = errors.New("upload is too slow")
+
+// withMinUploadRate aborts request bodies that arrive slower than rate
+// bytes per second on average, after the grace period. The read deadline
+// of the connection is moved forward as the data arrives, so that a client
+// which stops sending altogether is also cut off.
+func withMinUploadRate(rate int64, grace time.Duration, next http.Handler) http.Handler {
+	if grace <= 0 {
+		grace = 5 * time.Second
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rc := http.NewResponseController(w)
+		body := &minRateReader{body: r.Body, rc: rc, rate: rate, grace: grace, start: time.Now()}
+		r.Body = body
+		defer rc.SetReadDeadline(time.Time{})
+		next.ServeHTTP(w, r)
+	})
+}
+
+type minRateReader struct {
+	body  io.ReadCloser
+	rc    *http.ResponseController
+	rate  int64
+	grace time.Duration
+	start time.Time
+	n     int64
+}
+
+func (r *minRateReader) Read(p []byte) (int, error) {
+	deadline := r.deadline()
+	if time.Now().After(deadline) {
+		return 0, errSlowUpload
+	}
+	r.rc.SetReadDeadline(deadline)
+	n, err := r.body.Read(p)
+	r.n += int64(n)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = errSlowUpload
+	}
+	if err == io.EOF {
+		r.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// deadline is the time by which the next byte must arrive. It is computed
+// in float64, since n seconds in nanoseconds overflows int64 once the body
+// is past about 9 GB, and clamped to the largest duration.
+func (r *minRateReader) deadline() time.Time {
+	d := float64(r.grace) + float64(r.n+1)/float64(r.rate)*float64(time.Second)
+	if d >= math.MaxInt64 {
+		return r.start.Add(math.MaxInt64)
+	}
+	return r.start.Add(time.Duration(d))
+}
+
+func (r *minRateReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMinRateReaderDeadline(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		n, rate int64
+		want    time.Duration
+	}{
+		{0, 1024, 5*time.Second + time.Second/1024},
+		{1023, 1024, 6 * time.Second},
+		{10<<30 - 1, 1024, 5*time.Second + 10<<20*time.Second},
+	} {
+		r := &minRateReader{rate: tt.rate, grace: 5 * time.Second, start: start, n: tt.n}
+		if got := r.deadline().Sub(start); got != tt.want {
+			t.Errorf("deadline after %d bytes at %d B/s = %v, want %v", tt.n, tt.rate, got, tt.want)
+		}
+	}
+	r := &minRateReader{rate: 1, start: start, n: 1 << 62}
+	if !r.deadline().After(start.Add(100 * 365 * 24 * time.Hour)) {
+		t.Errorf("deadline for a huge body = %v, want far in the future", r.deadline())
+	}
+}
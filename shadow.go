@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type shadowConfig struct {
+	Upstream       string   `json:"upstream"`
+	Timeout        duration `json:"timeout,omitempty"`
+	MaxBodySize    int64    `json:"max_body_size,omitempty"`
+	CompareHeaders []string `json:"compare_headers,omitempty"`
+	IgnorePaths    []string `json:"ignore_paths,omitempty"`
+	ReportFile     string   `json:"report_file,omitempty"`
+}
+
+// shadowReport describes how the shadow response to a request differed from
+// the primary one.
+type shadowReport struct {
+	Time      time.Time `json:"time"`
+	Route     string    `json:"route"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Diffs     []string  `json:"diffs"`
+}
+
+const maxShadowDiffs = 20
+
+// shadow sends every request of a route to a shadow upstream as well, to
+// validate a new implementation of the upstream before switching to it.
+// The client gets the primary response, and the shadow one is compared
+// with it: the status, the compare_headers, and the bodies, which are
+// compared as JSON without the ignore_paths when both of them are JSON.
+type shadow struct {
+	*mirror
+	headers []string
+	ignore  [][]string
+	report  string
+}
+
+func newShadow(rc routeConfig) (*shadow, error) {
+	cfg := *rc.Shadow
+	m, err := newMirror(rc, mirrorConfig{Upstream: cfg.Upstream, Timeout: cfg.Timeout, MaxBodySize: cfg.MaxBodySize})
+	if err != nil {
+		return nil, err
+	}
+	s := &shadow{mirror: m, report: cfg.ReportFile}
+	for _, name := range cfg.CompareHeaders {
+		s.headers = append(s.headers, http.CanonicalHeaderKey(name))
+	}
+	for _, path := range cfg.IgnorePaths {
+		s.ignore = append(s.ignore, strings.Split(strings.TrimPrefix(strings.TrimPrefix(path, "$"), "."), "."))
+	}
+	m.compare = s.compare
+	return s, nil
+}
+
+func (s *shadow) compare(r *http.Request, primary, shadowed mirrorResult) {
+	var err error
+	if primary.body, err = decodeBody(primary.header, primary.body); err != nil {
+		proxyMetrics.shadowed.add(1, s.route, "error")
+		log.Printf("shadow response not compared on route %s, request %s: %v", s.route, requestID(r), err)
+		return
+	}
+	var diffs []string
+	switch {
+	case primary.err != nil || shadowed.err != nil:
+		if primary.err == nil || shadowed.err == nil {
+			diffs = append(diffs, fmt.Sprintf("error: %v != %v", primary.err, shadowed.err))
+		}
+	default:
+		if primary.status != shadowed.status {
+			diffs = append(diffs, fmt.Sprintf("status: %d != %d", primary.status, shadowed.status))
+		}
+		for _, name := range s.headers {
+			a, b := strings.Join(primary.header.Values(name), ", "), strings.Join(shadowed.header.Values(name), ", ")
+			if a != b {
+				diffs = append(diffs, fmt.Sprintf("header %s: %q != %q", name, a, b))
+			}
+		}
+		diffs = append(diffs, s.bodyDiffs(primary.body, shadowed.body)...)
+	}
+
+	result := "match"
+	switch {
+	case shadowed.err != nil:
+		result = "error"
+	case len(diffs) > 0:
+		result = "diff"
+	}
+	proxyMetrics.shadowed.add(1, s.route, result)
+	if len(diffs) == 0 {
+		return
+	}
+	if len(diffs) > maxShadowDiffs {
+		diffs = append(diffs[:maxShadowDiffs], fmt.Sprintf("and %d more", len(diffs)-maxShadowDiffs))
+	}
+	log.Printf("shadow diff on route %s, request %s: %s", s.route, requestID(r), strings.Join(diffs, "; "))
+	if s.report != "" {
+		err := s.writeReport(shadowReport{
+			Time:      time.Now(),
+			Route:     s.route,
+			RequestID: requestID(r),
+			Method:    r.Method,
+			URI:       r.URL.RequestURI(),
+			Diffs:     diffs,
+		})
+		if err != nil {
+			log.Printf("error writing %s: %v", s.report, err)
+		}
+	}
+}
+
+// writeReport appends the report to the report file as a JSON line.
+func (s *shadow) writeReport(report shadowReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.report, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// bodyDiffs compares the bodies as JSON when they both are, or byte by byte
+// otherwise.
+func (s *shadow) bodyDiffs(a, b []byte) []string {
+	va, errA := decodeJSON(a)
+	vb, errB := decodeJSON(b)
+	if errA != nil || errB != nil {
+		if bytes.Equal(a, b) {
+			return nil
+		}
+		return []string{fmt.Sprintf("body: %d bytes != %d bytes", len(a), len(b))}
+	}
+	for _, path := range s.ignore {
+		va = removeJSONPath(va, path)
+		vb = removeJSONPath(vb, path)
+	}
+	var diffs []string
+	jsonDiff("$", va, vb, &diffs)
+	return diffs
+}
+
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("trailing data")
+	}
+	return v, nil
+}
+
+// removeJSONPath removes the value at a path of object keys or array
+// indexes, where * matches all of them.
+func removeJSONPath(v any, path []string) any {
+	if len(path) == 0 {
+		return nil
+	}
+	key, rest := path[0], path[1:]
+	switch v := v.(type) {
+	case map[string]any:
+		for k := range v {
+			if key != "*" && k != key {
+				continue
+			}
+			if len(rest) == 0 {
+				delete(v, k)
+			} else {
+				v[k] = removeJSONPath(v[k], rest)
+			}
+		}
+	case []any:
+		for i := range v {
+			if key != "*" && key != strconv.Itoa(i) {
+				continue
+			}
+			if len(rest) == 0 {
+				v[i] = nil
+			} else {
+				v[i] = removeJSONPath(v[i], rest)
+			}
+		}
+	}
+	return v
+}
+
+// jsonDiff appends the paths where the JSON values differ, with numbers
+// compared by value.
+func jsonDiff(path string, a, b any, diffs *[]string) {
+	switch a := a.(type) {
+	case map[string]any:
+		if b, ok := b.(map[string]any); ok {
+			keys := sortedKeys(a)
+			for _, k := range sortedKeys(b) {
+				if _, ok := a[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			for _, k := range keys {
+				va, okA := a[k]
+				vb, okB := b[k]
+				switch {
+				case !okA:
+					*diffs = append(*diffs, fmt.Sprintf("body %s.%s: missing != %s", path, k, jsonText(vb)))
+				case !okB:
+					*diffs = append(*diffs, fmt.Sprintf("body %s.%s: %s != missing", path, k, jsonText(va)))
+				default:
+					jsonDiff(path+"."+k, va, vb, diffs)
+				}
+			}
+			return
+		}
+	case []any:
+		if b, ok := b.([]any); ok {
+			if len(a) != len(b) {
+				*diffs = append(*diffs, fmt.Sprintf("body %s: %d items != %d items", path, len(a), len(b)))
+				return
+			}
+			for i := range a {
+				jsonDiff(fmt.Sprintf("%s[%d]", path, i), a[i], b[i], diffs)
+			}
+			return
+		}
+	case json.Number:
+		if b, ok := b.(json.Number); ok {
+			fa, errA := a.Float64()
+			fb, errB := b.Float64()
+			if a == b || errA == nil && errB == nil && fa == fb {
+				return
+			}
+		}
+	default:
+		if a == b {
+			return
+		}
+	}
+	*diffs = append(*diffs, fmt.Sprintf("body %s: %s != %s", path, jsonText(a), jsonText(b)))
+}
+
+func jsonText(v any) string {
+	data, _ := json.Marshal(v)
+	if len(data) > 64 {
+		return string(data[:61]) + "..."
+	}
+	return string(data)
+}
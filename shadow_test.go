@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func mustDecodeJSON(t *testing.T, s string) any {
+	t.Helper()
+	v, err := decodeJSON([]byte(s))
+	if err != nil {
+		t.Fatalf("decodeJSON(%s): %v", s, err)
+	}
+	return v
+}
+
+func TestRemoveJSONPath(t *testing.T) {
+	for _, tt := range []struct {
+		doc, path, want string
+	}{
+		{`{"a":1,"b":2}`, "a", `{"b":2}`},
+		{`{"a":{"b":1,"c":2}}`, "a.b", `{"a":{"c":2}}`},
+		{`{"a":1}`, "x.y", `{"a":1}`},
+		{`{"a":1}`, "a.b", `{"a":1}`},
+		{`{"a":{"b":1},"c":{"b":2}}`, "*.b", `{"a":{},"c":{}}`},
+		{`{"items":[{"id":1,"t":"x"},{"id":2,"t":"y"}]}`, "items.*.t", `{"items":[{"id":1},{"id":2}]}`},
+		{`{"items":[{"id":1,"t":"x"},{"id":2,"t":"y"}]}`, "items.1.t", `{"items":[{"id":1,"t":"x"},{"id":2}]}`},
+		{`{"items":[{"id":1}]}`, "items.5.id", `{"items":[{"id":1}]}`},
+		{`{"items":[{"id":1}]}`, "items.x.id", `{"items":[{"id":1}]}`},
+		{`{"list":[1,2,3]}`, "list.0", `{"list":[null,2,3]}`},
+		{`[{"a":[{"b":1,"c":1}]},{"a":[{"b":2}]}]`, "*.a.*.b", `[{"a":[{"c":1}]},{"a":[{}]}]`},
+	} {
+		v := removeJSONPath(mustDecodeJSON(t, tt.doc), strings.Split(tt.path, "."))
+		got, _ := json.Marshal(v)
+		if string(got) != tt.want {
+			t.Errorf("remove %s from %s = %s, want %s", tt.path, tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestJSONDiff(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want []string
+	}{
+		{`{"a":1,"b":[1,2]}`, `{"b":[1,2],"a":1}`, nil},
+		{`{"n":1}`, `{"n":1.0}`, nil},
+		{`{"n":10}`, `{"n":1e1}`, nil},
+		{`{"a":1}`, `{"a":"1"}`, []string{`body $.a: 1 != "1"`}},
+		{`{"a":{}}`, `{"a":[]}`, []string{`body $.a: {} != []`}},
+		{`{"a":null}`, `{"a":false}`, []string{`body $.a: null != false`}},
+		{`{"a":1,"c":3}`, `{"a":1,"b":2}`, []string{`body $.c: 3 != missing`, `body $.b: missing != 2`}},
+		{`{"l":[1,2]}`, `{"l":[1,2,3]}`, []string{`body $.l: 2 items != 3 items`}},
+		{`{"l":[{"x":true},{"x":true}]}`, `{"l":[{"x":true},{"x":false}]}`, []string{`body $.l[1].x: true != false`}},
+		{`"text"`, `"other"`, []string{`body $: "text" != "other"`}},
+	} {
+		var diffs []string
+		jsonDiff("$", mustDecodeJSON(t, tt.a), mustDecodeJSON(t, tt.b), &diffs)
+		if strings.Join(diffs, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("diff %s %s = %q, want %q", tt.a, tt.b, diffs, tt.want)
+		}
+	}
+}
+
+func TestShadowBodyDiffs(t *testing.T) {
+	s := &shadow{ignore: [][]string{{"meta", "time"}, {"items", "*", "etag"}}}
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{`{"meta":{"time":1},"items":[{"id":1,"etag":"a"}]}`, `{"meta":{"time":2},"items":[{"id":1,"etag":"b"}]}`, 0},
+		{`{"meta":{"time":1},"items":[{"id":1}]}`, `{"meta":{"time":2},"items":[{"id":2}]}`, 1},
+		{`plain text`, `plain text`, 0},
+		{`plain text`, `other text`, 1},
+		{`{"a":1}`, `{"a":1} trailing`, 1},
+	} {
+		if diffs := s.bodyDiffs([]byte(tt.a), []byte(tt.b)); len(diffs) != tt.want {
+			t.Errorf("bodyDiffs(%s, %s) = %q, want %d diffs", tt.a, tt.b, diffs, tt.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+type signedURLConfig struct {
+	Secret string `json:"secret"`
+}
+
+// signedURLs verifies links of the form
+// /path?expires=<unix time>[&ip=<client IP>]&signature=<HMAC-SHA256>.
+type signedURLs struct {
+	secret []byte
+}
+
+func newSignedURLs(cfg signedURLConfig) (*signedURLs, error) {
+	if cfg.Secret == "" {
+		return nil, fmt.Errorf("secret is required")
+	}
+	return &signedURLs{secret: []byte(cfg.Secret)}, nil
+}
+
+func (s *signedURLs) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		expires, ip := q.Get("expires"), q.Get("ip")
+		signature, err := base64.RawURLEncoding.DecodeString(q.Get("signature"))
+		if err != nil || !hmac.Equal(signature, urlSignature(s.secret, r.URL.Path, expires, ip)) {
+			http.Error(w, "Invalid signature", http.StatusForbidden)
+			return
+		}
+		t, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || time.Now().Unix() > t {
+			http.Error(w, "Link expired", http.StatusGone)
+			return
+		}
+		if ip != "" {
+			if addr, err := netip.ParseAddr(ip); err != nil || addr.Unmap() != clientIP(r) {
+				http.Error(w, "Invalid signature", http.StatusForbidden)
+				return
+			}
+		}
+
+		q.Del("expires")
+		q.Del("ip")
+		q.Del("signature")
+		r.URL.RawQuery = q.Encode()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func urlSignature(secret []byte, path, expires, ip string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s", path, expires, ip)
+	return mac.Sum(nil)
+}
+
+func signURL(secret []byte, path string, expires time.Time, ip string) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	q := url.Values{"expires": {exp}}
+	if ip != "" {
+		q.Set("ip", ip)
+	}
+	q.Set("signature", base64.RawURLEncoding.EncodeToString(urlSignature(secret, path, exp, ip)))
+	u := url.URL{Path: path, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// signURLCommand implements "proxy sign-url [flags] <path>".
+func signURLCommand(args []string) {
+	flags := flag.NewFlagSet("sign-url", flag.ExitOnError)
+	secret := flags.String("secret", os.Getenv("SIGNED_URL_SECRET"), "HMAC secret, defaults to $SIGNED_URL_SECRET")
+	ttl := flags.Duration("ttl", time.Hour, "how long the link is valid")
+	ip := flags.String("ip", "", "client IP the link is bound to")
+	base := flags.String("base", "", "base URL to prepend, for example http://localhost:8000")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s sign-url [flags] <path>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *secret == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	fmt.Println(*base + signURL([]byte(*secret), flags.Arg(0), time.Now().Add(*ttl), *ip))
+}
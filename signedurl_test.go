@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLSignature(t *testing.T) {
+	// HMAC-SHA256 of "/files/report.pdf\n4102444800\n" with the key "secret".
+	got := base64.RawURLEncoding.EncodeToString(urlSignature([]byte("secret"), "/files/report.pdf", "4102444800", ""))
+	if want := "ki11rQL4MCIhdE7-UNydck8WgcVzEJGh-CQplCxlrqA"; got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+}
+
+func TestSignedURLs(t *testing.T) {
+	s, err := newSignedURLs(signedURLConfig{Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var query string
+	h := s.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+	}))
+	secret := []byte("secret")
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Minute)
+	valid := signURL(secret, "/files/report.pdf", future, "")
+
+	for _, tt := range []struct {
+		name   string
+		uri    string
+		remote string
+		status int
+	}{
+		{"valid", valid, "", http.StatusOK},
+		{"valid with query", valid + "&page=2", "", http.StatusOK},
+		{"expired", signURL(secret, "/files/report.pdf", past, ""), "", http.StatusGone},
+		{"other path", strings.Replace(valid, "report", "secret", 1), "", http.StatusForbidden},
+		{"other expiry", strings.Replace(valid, "expires=", "expires=1", 1), "", http.StatusForbidden},
+		{"other secret", signURL([]byte("other"), "/files/report.pdf", future, ""), "", http.StatusForbidden},
+		{"added ip", valid + "&ip=192.0.2.1", "", http.StatusForbidden},
+		{"no signature", "/files/report.pdf?expires=4102444800", "", http.StatusForbidden},
+		{"bound ip", signURL(secret, "/files/report.pdf", future, "192.0.2.1"), "192.0.2.1:1234", http.StatusOK},
+		{"bound mapped ip", signURL(secret, "/files/report.pdf", future, "192.0.2.1"), "[::ffff:192.0.2.1]:1234", http.StatusOK},
+		{"other ip", signURL(secret, "/files/report.pdf", future, "192.0.2.1"), "192.0.2.2:1234", http.StatusForbidden},
+		{"invalid ip", signURL(secret, "/files/report.pdf", future, "localhost"), "192.0.2.1:1234", http.StatusForbidden},
+	} {
+		query = ""
+		r := httptest.NewRequest("GET", tt.uri, nil)
+		if tt.remote != "" {
+			r.RemoteAddr = tt.remote
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if w.Code == http.StatusOK && strings.Contains(query, "signature") {
+			t.Errorf("%s: query %q passed upstream with the signature", tt.name, query)
+		}
+	}
+}
+
+func TestNewSignedURLsWithoutSecret(t *testing.T) {
+	if _, err := newSignedURLs(signedURLConfig{}); err == nil {
+		t.Error("signed URLs without a secret accepted")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// statusBoard keeps what the admin dashboard shows besides the metrics:
+// request rates over the last minute, the state of the upstreams and the
+// most recent errors.
+type statusBoard struct {
+	mu        sync.Mutex
+	rates     map[string]*rateCounter
+	upstreams map[string]*upstreamStatus
+	errors    []errorEntry
+	next      int
+}
+
+type upstreamStatus struct {
+	Upstream    string     `json:"upstream"`
+	Up          bool       `json:"up"`
+	Requests    uint64     `json:"requests"`
+	Errors      uint64     `json:"errors"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+type errorEntry struct {
+	Time      time.Time `json:"time"`
+	Route     string    `json:"route"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error,omitempty"`
+}
+
+const recentErrors = 50
+
+var proxyStatus = &statusBoard{
+	rates:     make(map[string]*rateCounter),
+	upstreams: make(map[string]*upstreamStatus),
+}
+
+// requestDone counts a finished request and remembers it when it failed.
+func (b *statusBoard) requestDone(r *http.Request, status int) {
+	info := infoOf(r)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rate := b.rates[info.route]
+	if rate == nil {
+		rate = &rateCounter{}
+		b.rates[info.route] = rate
+	}
+	rate.add(time.Now())
+
+	if status < 500 {
+		return
+	}
+	e := errorEntry{
+		Time:      info.start,
+		Route:     info.route,
+		RequestID: info.requestID,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    status,
+		Error:     info.upstreamError,
+	}
+	if len(b.errors) < recentErrors {
+		b.errors = append(b.errors, e)
+	} else {
+		b.errors[b.next] = e
+	}
+	b.next = (b.next + 1) % recentErrors
+}
+
+// upstreamDone records the outcome of a request to an upstream. Requests
+// cancelled by the client say nothing about the upstream and are ignored.
+func (b *statusBoard) upstreamDone(upstream string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u := b.upstreams[upstream]
+	if u == nil {
+		u = &upstreamStatus{Upstream: upstream}
+		b.upstreams[upstream] = u
+	}
+	u.Requests++
+	now := time.Now()
+	if err != nil {
+		u.Up = false
+		u.Errors++
+		u.LastError, u.LastErrorAt = err.Error(), &now
+		return
+	}
+	u.Up = true
+	u.LastSuccess = &now
+}
+
+type routeStatus struct {
+	Name        string         `json:"name"`
+	Prefix      string         `json:"prefix"`
+	Stub        bool           `json:"stub,omitempty"`
+	Maintenance bool           `json:"maintenance"`
+	Targets     []targetStatus `json:"targets,omitempty"`
+	Rate        float64        `json:"requests_per_second"`
+	InFlight    float64        `json:"in_flight"`
+}
+
+type targetStatus struct {
+	URL      string `json:"url"`
+	Weight   int    `json:"weight"`
+	Drain    bool   `json:"drain"`
+	InFlight int64  `json:"in_flight"`
+}
+
+type statusSnapshot struct {
+	Time                time.Time        `json:"time"`
+	Version             uint64           `json:"version"`
+	Routes              []routeStatus    `json:"routes"`
+	Upstreams           []upstreamStatus `json:"upstreams"`
+	ClientConnections   float64          `json:"client_connections"`
+	UpstreamConnections float64          `json:"upstream_connections"`
+	RecentErrors        []errorEntry     `json:"recent_errors"`
+}
+
+func (b *statusBoard) snapshot(table *routingTable) statusSnapshot {
+	now := time.Now()
+	s := statusSnapshot{
+		Time:                now,
+		Version:             table.version,
+		ClientConnections:   proxyMetrics.clientConns.sum(),
+		UpstreamConnections: proxyMetrics.upstreamConnsOpen.sum(),
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, rc := range table.configs {
+		rs := routeStatus{Name: rc.Name, Prefix: rc.Prefix, Stub: rc.Stub != nil}
+		rs.Maintenance = rc.Maintenance != nil && rc.Maintenance.Enabled
+		for _, t := range table.routes[i].targets {
+			rs.Targets = append(rs.Targets, targetStatus{URL: t.url.String(), Weight: t.weight, Drain: t.drain, InFlight: t.inFlight.Load()})
+		}
+		if rate := b.rates[rc.Name]; rate != nil {
+			rs.Rate = rate.rate(now)
+		}
+		rs.InFlight = proxyMetrics.inFlight.value(rc.Name)
+		s.Routes = append(s.Routes, rs)
+	}
+	for _, name := range sortedKeys(b.upstreams) {
+		s.Upstreams = append(s.Upstreams, *b.upstreams[name])
+	}
+	s.RecentErrors = append(s.RecentErrors, b.errors...)
+	sort.Slice(s.RecentErrors, func(i, j int) bool { return s.RecentErrors[i].Time.After(s.RecentErrors[j].Time) })
+	return s
+}
+
+// rateCounter counts events in one second buckets over the last minute.
+type rateCounter struct {
+	counts  [60]uint64
+	seconds [60]int64
+}
+
+func (c *rateCounter) add(now time.Time) {
+	sec := now.Unix()
+	i := sec % 60
+	if c.seconds[i] != sec {
+		c.seconds[i], c.counts[i] = sec, 0
+	}
+	c.counts[i]++
+}
+
+func (c *rateCounter) rate(now time.Time) float64 {
+	var total uint64
+	for i, sec := range c.seconds {
+		if now.Unix()-sec < 60 {
+			total += c.counts[i]
+		}
+	}
+	return float64(total) / 60
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"text/template"
+	"time"
+)
+
+type stubConfig struct {
+	Status   int               `json:"status,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	BodyFile string            `json:"body_file,omitempty"`
+	Template bool              `json:"template,omitempty"`
+}
+
+// stubRequest is the request data available to stub templates.
+type stubRequest struct {
+	Method    string
+	Path      string
+	Query     url.Values
+	Host      string
+	Header    http.Header
+	ClientIP  string
+	RequestID string
+	Route     string
+	Time      time.Time
+}
+
+// newStub returns a handler answering with a fixed status, headers and body.
+// The body is given inline or in a file, and is a text/template over
+// stubRequest when template is set.
+func newStub(cfg stubConfig) (http.Handler, error) {
+	body := []byte(cfg.Body)
+	if cfg.BodyFile != "" {
+		data, err := os.ReadFile(cfg.BodyFile)
+		if err != nil {
+			return nil, err
+		}
+		body = data
+	}
+	status := cfg.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	var t *template.Template
+	if cfg.Template {
+		var err error
+		if t, err = template.New("stub").Parse(string(body)); err != nil {
+			return nil, err
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out := body
+		if t != nil {
+			info := infoOf(r)
+			var buf bytes.Buffer
+			err := t.Execute(&buf, stubRequest{
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Query:     r.URL.Query(),
+				Host:      r.Host,
+				Header:    r.Header,
+				ClientIP:  clientIP(r).String(),
+				RequestID: info.requestID,
+				Route:     info.route,
+				Time:      time.Now(),
+			})
+			if err != nil {
+				log.Printf("error executing stub template of route %s: %v", info.route, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			out = buf.Bytes()
+		}
+		for name, value := range cfg.Headers {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(status)
+		w.Write(out)
+	}), nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type tracingConfig struct {
+	Exporter    string            `json:"exporter"`
+	Endpoint    string            `json:"endpoint"`
+	Headers     map[string]string `json:"headers"`
+	ServiceName string            `json:"service_name"`
+	SampleRate  float64           `json:"sample_rate"`
+}
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// span is a finished or running operation of a trace. Spans which are not
+// sampled are still created, so that the trace context is propagated, but
+// they are not exported.
+type span struct {
+	tracer  *tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	sampled bool
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   []attribute
+	err     string
+}
+
+func (s *span) child(name string, kind int) *span {
+	c := &span{tracer: s.tracer, traceID: s.traceID, parent: s.spanID, sampled: s.sampled, name: name, kind: kind, start: time.Now()}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+func (s *span) set(key string, value any) {
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+func (s *span) finish() {
+	s.end = time.Now()
+	if s.sampled {
+		s.tracer.export(s)
+	}
+}
+
+// traceparent formats the W3C trace context of the span.
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// parseTraceparent returns the trace ID, parent span ID and sampled flag of
+// a traceparent header.
+func parseTraceparent(h string) (traceID [16]byte, parent [8]byte, sampled bool, ok bool) {
+	if len(h) < 55 || h[2] != '-' || h[35] != '-' || h[52] != '-' || h[:2] == "ff" || (h[:2] == "00" && len(h) != 55) {
+		return traceID, parent, false, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(traceID[:], []byte(h[3:35])); err != nil {
+		return traceID, parent, false, false
+	}
+	if _, err := hex.Decode(parent[:], []byte(h[36:52])); err != nil {
+		return traceID, parent, false, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(h[53:55])); err != nil {
+		return traceID, parent, false, false
+	}
+	if traceID == [16]byte{} || parent == [8]byte{} {
+		return traceID, parent, false, false
+	}
+	return traceID, parent, flags[0]&1 == 1, true
+}
+
+// tracer creates a server span for every request, continuing the trace of
+// an incoming traceparent header, and exports the sampled spans in batches
+// over OTLP/HTTP with the JSON encoding, or to stdout.
+type tracer struct {
+	service  string
+	rate     float64
+	endpoint string
+	headers  map[string]string
+	out      io.Writer
+	queue    chan *span
+}
+
+func newTracer(cfg tracingConfig) (*tracer, error) {
+	t := &tracer{service: cfg.ServiceName, rate: cfg.SampleRate, headers: cfg.Headers, queue: make(chan *span, 4096)}
+	if t.service == "" {
+		t.service = "go-reverse-proxy"
+	}
+	if t.rate == 0 {
+		t.rate = 1
+	}
+	if t.rate < 0 || t.rate > 1 {
+		return nil, fmt.Errorf("sample rate %v is not between 0 and 1", t.rate)
+	}
+	switch cfg.Exporter {
+	case "", "otlp":
+		t.endpoint = cfg.Endpoint
+		if t.endpoint == "" {
+			t.endpoint = "http://localhost:4318/v1/traces"
+		}
+	case "stdout":
+		t.out = os.Stdout
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", cfg.Exporter)
+	}
+	go t.run()
+	return t, nil
+}
+
+type spanKey struct{}
+
+func spanOf(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+func (t *tracer) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &span{tracer: t, kind: spanKindServer, start: time.Now()}
+		if traceID, parent, sampled, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+			s.traceID, s.parent, s.sampled = traceID, parent, sampled
+		} else {
+			rand.Read(s.traceID[:])
+			s.sampled = t.rate >= 1 || mathrand.Float64() < t.rate
+		}
+		rand.Read(s.spanID[:])
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), spanKey{}, s)))
+
+		route := infoOf(r).route
+		s.name = r.Method + " " + route
+		s.set("http.request.method", r.Method)
+		s.set("url.path", r.URL.Path)
+		s.set("server.address", r.Host)
+		s.set("client.address", clientIP(r).String())
+		s.set("user_agent.original", r.UserAgent())
+		s.set("proxy.route", route)
+		s.set("http.response.status_code", sw.status())
+		if sw.status() >= 500 {
+			s.err = http.StatusText(sw.status())
+		}
+		s.finish()
+	})
+}
+
+// traceUpstreamSpan starts the client span of an upstream request, sets the
+// traceparent header for the upstream and records dial, TLS, time to first
+// byte and connection retries as child spans.
+func traceUpstreamSpan(req *http.Request) (*http.Request, *span) {
+	parent := spanOf(req.Context())
+	if parent == nil {
+		return req, nil
+	}
+	s := parent.child(req.Method+" "+req.URL.Host, spanKindClient)
+	s.set("http.request.method", req.Method)
+	s.set("server.address", req.URL.Hostname())
+	s.set("url.full", req.URL.Scheme+"://"+req.URL.Host+req.URL.Path)
+
+	var mu sync.Mutex
+	running := make(map[string]*span)
+	begin := func(key, name string, attrs ...attribute) {
+		mu.Lock()
+		c := s.child(name, spanKindInternal)
+		c.attrs = attrs
+		running[key] = c
+		mu.Unlock()
+	}
+	end := func(key string, err error) {
+		mu.Lock()
+		c := running[key]
+		delete(running, key)
+		mu.Unlock()
+		if c == nil {
+			return
+		}
+		if err != nil {
+			c.err = err.Error()
+		}
+		c.finish()
+	}
+	attempts := 0
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			mu.Lock()
+			attempts++
+			n := attempts
+			mu.Unlock()
+			if n > 1 {
+				retry := s.child("retry", spanKindInternal)
+				retry.set("proxy.attempt", n)
+				retry.finish()
+			}
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			begin("dns", "dns", attribute{"server.address", info.Host})
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) { end("dns", info.Err) },
+		ConnectStart: func(network, addr string) {
+			begin("dial "+addr, "dial", attribute{"network.peer.address", addr})
+		},
+		ConnectDone:       func(network, addr string, err error) { end("dial "+addr, err) },
+		TLSHandshakeStart: func() { begin("tls", "tls") },
+		TLSHandshakeDone:  func(_ tls.ConnectionState, err error) { end("tls", err) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			s.set("proxy.connection_reused", info.Reused)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			begin("ttfb", "ttfb")
+			if info.Err != nil {
+				end("ttfb", info.Err)
+			}
+		},
+		GotFirstResponseByte: func() { end("ttfb", nil) },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	req.Header.Set("Traceparent", s.traceparent())
+	return req, s
+}
+
+func (t *tracer) export(s *span) {
+	select {
+	case t.queue <- s:
+	default:
+	}
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(5 * time.Second)
+	var batch []*span
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < 512 {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.send(batch); err != nil {
+			log.Printf("error exporting %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+func (t *tracer) send(batch []*span) error {
+	spans := make([]any, len(batch))
+	for i, s := range batch {
+		spans[i] = s.otlp()
+	}
+	data, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttributes([]attribute{{"service.name", t.service}})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "go-reverse-proxy"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if t.out != nil {
+		_, err := t.out.Write(append(data, '\n'))
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *span) otlp() map[string]any {
+	m := map[string]any{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parent != [8]byte{} {
+		m["parentSpanId"] = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != "" {
+		m["status"] = map[string]any{"code": 2, "message": s.err}
+	}
+	return m
+}
+
+func otlpAttributes(attrs []attribute) []any {
+	list := make([]any, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]any
+		switch v := a.value.(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		list = append(list, map[string]any{"key": a.key, "value": value})
+	}
+	return list
+}
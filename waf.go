@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+type wafConfig struct {
+	Mode             string   `json:"mode"`
+	BodyLimit        int64    `json:"body_limit"`
+	Exclude          []string `json:"exclude"`
+	ForbiddenMethods []string `json:"forbidden_methods"`
+}
+
+type wafRule struct {
+	ID      string   `json:"id"`
+	Targets []string `json:"targets"`
+	Pattern string   `json:"pattern"`
+	Mode    string   `json:"mode"`
+}
+
+// builtinWAFRules are a small set of signatures for the usual suspects.
+// They are meant to stop scanners and obvious probes, not to replace a
+// full featured WAF, and are kept narrow to let ordinary text through.
+// The encoded null bytes are found in the decoded path and query.
+var builtinWAFRules = []wafRule{
+	{ID: "sqli-union", Targets: []string{"query", "body"}, Pattern: `(?i)\bunion(\s|/\*[\s\S]*?\*/)+((all|distinct)(\s|/\*[\s\S]*?\*/)+)?select\b`},
+	{ID: "sqli-tautology", Targets: []string{"query", "body"}, Pattern: `(?i)['"]\s*(or|and)\s+(['"][^'"]*['"]|\d+)\s*(=|like)\s*(['"]|\d)`},
+	{ID: "sqli-comment", Targets: []string{"query"}, Pattern: `['"]\s*(--|#)\s*$`},
+	{ID: "sqli-stacked", Targets: []string{"query", "body"}, Pattern: `(?i);\s*(drop\s+(table|database|schema)|delete\s+from|insert\s+into|update\s+\w+\s+set|alter\s+table|create\s+(table|database|user)|truncate\s+(table\s+)?\w)\b`},
+	{ID: "sqli-timing", Targets: []string{"query", "body", "headers"}, Pattern: `(?i)\b(sleep|benchmark|pg_sleep)\s*\(|\bwaitfor\s+delay\b`},
+	{ID: "xss-script", Targets: []string{"query", "body", "headers"}, Pattern: `(?i)<\s*/?\s*script\b`},
+	{ID: "xss-handler", Targets: []string{"query", "body"}, Pattern: `(?i)<[^>]*\bon[a-z]+\s*=`},
+	{ID: "xss-uri", Targets: []string{"query", "body"}, Pattern: `(?i)\b(javascript|vbscript)\s*:`},
+	{ID: "path-traversal", Targets: []string{"path", "query"}, Pattern: `(?i)(^|[/\\])\.\.([/\\]|$)|%2e%2e(%2f|%5c|/|\\)`},
+	{ID: "null-byte", Targets: []string{"path", "query", "headers"}, Pattern: `\x00`},
+}
+
+// waf evaluates the request path, query, headers and the beginning of the
+// body against the built-in and the configured rules. In "log" mode
+// matches are only logged.
+type waf struct {
+	route     string
+	logOnly   bool
+	bodyLimit int64
+	methods   map[string]bool
+	rules     []compiledWAFRule
+}
+
+type compiledWAFRule struct {
+	id      string
+	targets map[string]bool
+	re      *regexp.Regexp
+	logOnly bool
+}
+
+func newWAF(route string, cfg wafConfig, custom []wafRule) (*waf, error) {
+	w := &waf{route: route, methods: make(map[string]bool), bodyLimit: cfg.BodyLimit}
+	switch cfg.Mode {
+	case "", "block":
+	case "log":
+		w.logOnly = true
+	default:
+		return nil, fmt.Errorf("unknown mode %q", cfg.Mode)
+	}
+	if w.bodyLimit == 0 {
+		w.bodyLimit = 64 << 10
+	}
+	for _, m := range cfg.ForbiddenMethods {
+		w.methods[strings.ToUpper(m)] = true
+	}
+
+	excluded := make(map[string]bool)
+	for _, id := range cfg.Exclude {
+		excluded[id] = true
+	}
+	for _, rule := range append(builtinWAFRules[:len(builtinWAFRules):len(builtinWAFRules)], custom...) {
+		if excluded[rule.ID] {
+			continue
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern of rule %s: %v", rule.ID, err)
+		}
+		compiled := compiledWAFRule{id: rule.ID, targets: make(map[string]bool), re: re}
+		switch rule.Mode {
+		case "", "block":
+		case "log":
+			compiled.logOnly = true
+		default:
+			return nil, fmt.Errorf("unknown mode %q of rule %s", rule.Mode, rule.ID)
+		}
+		for _, t := range rule.Targets {
+			switch t {
+			case "path", "query", "headers", "body":
+				compiled.targets[t] = true
+			default:
+				return nil, fmt.Errorf("unknown target %q of rule %s", t, rule.ID)
+			}
+		}
+		w.rules = append(w.rules, compiled)
+	}
+	return w, nil
+}
+
+func (w *waf) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if w.methods[r.Method] {
+			if w.report(r, "forbidden-method", "method", !w.logOnly) {
+				http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+		}
+
+		var body []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, w.bodyLimit))
+			if err != nil {
+				http.Error(rw, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			r.Body = prependBody(r.Body, body)
+		}
+
+		inputs := w.inputs(r, body)
+	rules:
+		for _, rule := range w.rules {
+			for target, values := range inputs {
+				if !rule.targets[target] {
+					continue
+				}
+				for _, v := range values {
+					if !rule.re.MatchString(v) {
+						continue
+					}
+					if w.report(r, rule.id, target, !w.logOnly && !rule.logOnly) {
+						http.Error(rw, "Forbidden", http.StatusForbidden)
+						return
+					}
+					continue rules
+				}
+			}
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// inputs collects the values inspected for each target. Both the raw and
+// the decoded forms are checked, so that encoding does not hide a match.
+func (w *waf) inputs(r *http.Request, body []byte) map[string][]string {
+	inputs := map[string][]string{
+		"path":  {r.URL.EscapedPath(), r.URL.Path},
+		"query": {r.URL.RawQuery},
+	}
+	q, _ := url.ParseQuery(r.URL.RawQuery)
+	for k, values := range q {
+		inputs["query"] = append(inputs["query"], k)
+		inputs["query"] = append(inputs["query"], values...)
+	}
+	for _, values := range r.Header {
+		inputs["headers"] = append(inputs["headers"], values...)
+	}
+	if len(body) > 0 {
+		inputs["body"] = []string{string(body)}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			form, _ := url.ParseQuery(string(body))
+			for _, values := range form {
+				inputs["body"] = append(inputs["body"], values...)
+			}
+		}
+	}
+	return inputs
+}
+
+func (w *waf) report(r *http.Request, rule, target string, block bool) bool {
+	action := "logged"
+	if block {
+		action = "blocked"
+	}
+	log.Printf("waf: %s %s %s: rule %s matched %s on route %s from %s, request %s",
+		action, r.Method, r.URL.Path, rule, target, w.route, clientIP(r), requestID(r))
+	return block
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type wafRequest struct {
+	name    string
+	method  string
+	uri     string
+	header  http.Header
+	body    string
+	blocked string
+}
+
+func serveWAF(t *testing.T, w *waf, tt wafRequest) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	var received string
+	h := w.wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received = string(b)
+	}))
+	method := tt.method
+	if method == "" {
+		method = "POST"
+	}
+	r := httptest.NewRequest(method, tt.uri, strings.NewReader(tt.body))
+	for name, values := range tt.header {
+		r.Header[name] = values
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+	return rw, received
+}
+
+// TestWAFBenign checks the built-in rules against ordinary requests, which
+// must pass in block mode.
+func TestWAFBenign(t *testing.T) {
+	w, err := newWAF("test", wafConfig{Mode: "block"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json := http.Header{"Content-Type": {"application/json"}}
+	form := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	for _, tt := range []wafRequest{
+		{name: "ranges", uri: "/search?range=1..10&v=1.0..2.0&q=to+be+continued..."},
+		{name: "dotted names", uri: "/files/archive..tar.gz?name=a..b"},
+		{name: "union in prose", uri: "/search?q=European+Union.+Select+your+country"},
+		{name: "quotes and conjunctions", uri: "/search?q=O%27Reilly+and+friends&a=%22or+something+like+this%22"},
+		{name: "encoded null in referer", uri: "/", header: http.Header{"Referer": {"https://example.com/page?id=a%00b"}}},
+		{name: "percent in query", uri: "/search?discount=100%25&color=%2300ff00"},
+		{name: "JSON body", uri: "/api", header: json, body: `{"name":"O'Reilly","note":"or something like this","todo":"done; update the docs","cmp":"a < b and c > d","lang":"javascript","on":"x=1","path":"../up","tags":["union","select"]}`},
+		{name: "JSON with markup", uri: "/api", header: json, body: `{"html":"<p class=\"note\">Hello</p>","expr":"x <= y","online":true}`},
+		{name: "form body", uri: "/api", header: form, body: `comment=I+said+%22and+so+on%22%3B+delete+it+later&rating=5`},
+	} {
+		rw, received := serveWAF(t, w, tt)
+		if rw.Code != http.StatusOK {
+			t.Errorf("%s: status %d", tt.name, rw.Code)
+		}
+		if received != tt.body {
+			t.Errorf("%s: upstream got body %q, want %q", tt.name, received, tt.body)
+		}
+	}
+}
+
+func TestWAFBlocked(t *testing.T) {
+	w, err := newWAF("test", wafConfig{ForbiddenMethods: []string{"trace"}}, []wafRule{
+		{ID: "no-wp", Targets: []string{"path"}, Pattern: `(?i)/wp-admin`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []wafRequest{
+		{name: "union select", uri: "/?id=1+UNION+ALL+SELECT+password+FROM+users"},
+		{name: "union comment select", uri: "/?id=1%20union/**/select%201"},
+		{name: "tautology", uri: "/?user=admin%27+or+%271%27%3D%271"},
+		{name: "numeric tautology", uri: "/?id=%22+or+1%3D1"},
+		{name: "comment", uri: "/?user=admin%27--"},
+		{name: "stacked", uri: "/?id=1%3B+DROP+TABLE+users"},
+		{name: "timing header", uri: "/", header: http.Header{"User-Agent": {"x' and sleep(5)"}}},
+		{name: "script", uri: "/?q=%3Cscript%3Ealert(1)%3C/script%3E"},
+		{name: "handler", uri: "/", header: http.Header{"Content-Type": {"application/json"}}, body: `{"bio":"<img src=x onerror=alert(1)>"}`},
+		{name: "javascript uri", uri: "/?next=javascript:alert(1)"},
+		{name: "traversal", uri: "/?file=../../etc/passwd"},
+		{name: "encoded traversal", uri: "/static/%2e%2e%2fsecret"},
+		{name: "null byte", uri: "/?file=a.txt%00.png"},
+		{name: "form stacked", uri: "/", header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}, body: "q=1%3B+delete+from+users"},
+		{name: "custom rule", uri: "/wp-admin/"},
+	} {
+		if rw, _ := serveWAF(t, w, tt); rw.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", tt.name, rw.Code)
+		}
+	}
+	if rw, _ := serveWAF(t, w, wafRequest{method: "TRACE", uri: "/"}); rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("forbidden method: status %d, want 405", rw.Code)
+	}
+}
+
+func TestWAFLogMode(t *testing.T) {
+	logged, err := newWAF("test", wafConfig{Mode: "log"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rw, _ := serveWAF(t, logged, wafRequest{uri: "/?file=../../etc/passwd"}); rw.Code != http.StatusOK {
+		t.Errorf("log mode route: status %d, want 200", rw.Code)
+	}
+	rules := []wafRule{{ID: "agent", Targets: []string{"headers"}, Pattern: "sqlmap", Mode: "log"}}
+	w, err := newWAF("test", wafConfig{Exclude: []string{"path-traversal"}}, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []wafRequest{
+		{name: "log mode rule", uri: "/", header: http.Header{"User-Agent": {"sqlmap/1.7"}}},
+		{name: "excluded rule", uri: "/?file=../../etc/passwd"},
+	} {
+		if rw, _ := serveWAF(t, w, tt); rw.Code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", tt.name, rw.Code)
+		}
+	}
+}
+
+func TestWAFConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		cfg   wafConfig
+		rules []wafRule
+	}{
+		{"route mode", wafConfig{Mode: "blok"}, nil},
+		{"rule mode", wafConfig{}, []wafRule{{ID: "x", Targets: []string{"path"}, Pattern: "x", Mode: "blok"}}},
+		{"target", wafConfig{}, []wafRule{{ID: "x", Targets: []string{"cookies"}, Pattern: "x"}}},
+		{"pattern", wafConfig{}, []wafRule{{ID: "x", Targets: []string{"path"}, Pattern: "("}}},
+	} {
+		if _, err := newWAF("test", tt.cfg, tt.rules); err == nil {
+			t.Errorf("invalid %s accepted", tt.name)
+		}
+	}
+}